@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// statusRecorder captures the status code and body size written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+// WriteHeader records the status code before passing it on
+func (sr *statusRecorder) WriteHeader(status int) {
+	if sr.status == 0 {
+		sr.status = status
+	}
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+// Write records the number of body bytes written
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	n, err := sr.ResponseWriter.Write(b)
+	sr.bytes += int64(n)
+	return n, err
+}
+
+// ReadFrom records the bytes copied from src, passing the copy on so the connection can still use sendfile(2)
+func (sr *statusRecorder) ReadFrom(src io.Reader) (int64, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	n, err := io.Copy(sr.ResponseWriter, src)
+	sr.bytes += n
+	return n, err
+}
+
+// Flush lets streaming handlers flush through the recorder
+func (sr *statusRecorder) Flush() {
+	if flusher, ok := sr.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack hands the connection over to WebSocket handlers, recording the 101 Switching Protocols they answer with
+func (sr *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusSwitchingProtocols
+	}
+	return http.NewResponseController(sr.ResponseWriter).Hijack()
+}
+
+// Unwrap exposes the underlying ResponseWriter to http.ResponseController
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
+// accessLog writes one line per request to stdout or to a file that can be reopened for log rotation
+type accessLog struct {
+	mu     sync.Mutex
+	path   string
+	format string
+	out    io.Writer
+	file   *os.File
+}
+
+// newAccessLog opens the access log configured by path ("stdout" or a file path) in the given format
+func newAccessLog(path, format string) (*accessLog, error) {
+	al := &accessLog{path: path, format: format}
+	if path == "stdout" {
+		al.out = os.Stdout
+		return al, nil
+	}
+	if err := al.reopen(); err != nil {
+		return nil, err
+	}
+	return al, nil
+}
+
+// reopen closes and reopens the log file, picking up a file that was moved away by logrotate
+func (al *accessLog) reopen() error {
+	if al.path == "stdout" {
+		return nil
+	}
+	file, err := os.OpenFile(al.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("\u65e0\u6cd5\u6253\u5f00\u8bbf\u95ee\u65e5\u5fd7: %v", err)
+	}
+	al.mu.Lock()
+	old := al.file
+	al.file = file
+	al.out = file
+	al.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+// reopenOnSIGHUP reopens the log file every time the process receives SIGHUP
+func (al *accessLog) reopenOnSIGHUP() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			if err := al.reopen(); err != nil {
+				server.logger().Error("\u65e0\u6cd5\u91cd\u65b0\u6253\u5f00\u8bbf\u95ee\u65e5\u5fd7", slog.String("path", al.path), slog.Any("error", err))
+			}
+		}
+	}()
+}
+
+// write formats and writes a single access log entry
+func (al *accessLog) write(r *http.Request, status int, bytes int64, t time.Time) {
+	remoteAddr := clientIP(r)
+	referer := r.Referer()
+	userAgent := r.UserAgent()
+
+	var line []byte
+	switch al.format {
+	case "json":
+		line, _ = json.Marshal(map[string]interface{}{
+			"remote_addr": remoteAddr,
+			"time":        t.Format(time.RFC3339),
+			"method":      r.Method,
+			"uri":         r.RequestURI,
+			"status":      status,
+			"bytes_sent":  bytes,
+			"referer":     referer,
+			"user_agent":  userAgent,
+		})
+		line = append(line, '\n')
+	case "common":
+		line = []byte(fmt.Sprintf("%s - - [%s] \"%s %s %s\" %d %s\n",
+			remoteAddr, t.Format("02/Jan/2006:15:04:05 -0700"), r.Method, r.RequestURI, r.Proto, status, clfBytes(bytes)))
+	default:
+		line = []byte(fmt.Sprintf("%s - - [%s] \"%s %s %s\" %d %s %q %q\n",
+			remoteAddr, t.Format("02/Jan/2006:15:04:05 -0700"), r.Method, r.RequestURI, r.Proto, status, clfBytes(bytes), clfField(referer), clfField(userAgent)))
+	}
+
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	al.out.Write(line)
+}
+
+// clfBytes formats a byte count the way CLF does, using "-" for an empty body
+func clfBytes(bytes int64) string {
+	if bytes == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%d", bytes)
+}
+
+// clfField formats an optional header value the way CLF does, using "-" when it is absent
+func clfField(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+// withAccessLog writes an access log entry for every request handled by next
+func withAccessLog(next http.Handler, al *accessLog) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+		status := recorder.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		al.write(r, status, recorder.bytes, start)
+	})
+}
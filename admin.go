@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// handleShutdown implements POST /admin/shutdown: it answers 202 Accepted and then shuts the server down gracefully,
+// giving in-flight requests up to shutdown_timeout to finish
+func handleShutdown(w http.ResponseWriter, r *http.Request, config *Config) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, "405 Method Not Allowed", "METHOD_NOT_ALLOWED")
+		return
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if config.AdminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(config.AdminToken)) != 1 {
+		writeError(w, http.StatusForbidden, "403 Forbidden", "INVALID_TOKEN")
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+
+	// Every request in flight except this one has to be drained
+	drained := server.inFlight.Load() - 1
+	go func() {
+		server.logger().Info("\u6536\u5230\u5173\u95ed\u8bf7\u6c42\uff0c\u6b63\u5728\u7b49\u5f85\u8bf7\u6c42\u5b8c\u6210", slog.Int64("in_flight", drained))
+		ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			server.logger().Error("\u4f18\u96c5\u5173\u95ed\u8d85\u65f6", slog.Int64("in_flight", server.inFlight.Load()), slog.Any("error", err))
+			return
+		}
+		server.logger().Info("\u670d\u52a1\u5668\u5df2\u5173\u95ed", slog.Int64("drained", drained))
+	}()
+}
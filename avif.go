@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// avifSources are the source extensions transcoded to AVIF when avif_enabled is set
+var avifSources = map[string]bool{".jpg": true, ".jpeg": true, ".png": true}
+
+// acceptsAVIF reports whether the Accept header lists image/avif with a non-zero quality
+func acceptsAVIF(r *http.Request) bool {
+	return contains(acceptedTypes(r.Header.Get("Accept")), "image/avif")
+}
+
+// serveAVIF serves the JPEG or PNG at imagePath transcoded to AVIF, reusing earlier results from the content cache.
+// It reports false without writing a body when the client does not accept AVIF or transcoding fails, so the caller
+// can serve the original file instead.
+func serveAVIF(w http.ResponseWriter, r *http.Request, config *Config, imagePath string) bool {
+	if !avifSources[strings.ToLower(filepath.Ext(imagePath))] {
+		return false
+	}
+	// The body depends on Accept, so shared caches must keep the AVIF and original responses apart
+	w.Header().Add("Vary", "Accept")
+	if !avifSupported || !acceptsAVIF(r) {
+		return false
+	}
+	info, err := os.Stat(imagePath)
+	if err != nil {
+		return false
+	}
+	key := fmt.Sprintf("avif|%s|%d|%d", imagePath, info.ModTime().UnixNano(), *config.AVIFQuality)
+
+	content, cached := contentLRU.Get(key)
+	w.Header().Set("X-Cache", "HIT")
+	if !cached {
+		data, err := transcodeAVIF(imagePath, *config.AVIFQuality)
+		if err != nil {
+			w.Header().Del("X-Cache")
+			server.logger().Warn("AVIF transcoding failed, serving the original", "path", imagePath, "error", err)
+			return false
+		}
+		w.Header().Set("X-Cache", "MISS")
+		content = cachedContent{ContentType: "image/avif", Data: data}
+		contentLRU.Add(key, content)
+	}
+
+	setTranscodedDisposition(w, imagePath, content.ContentType)
+	serveCachedContent(w, r, content, info.ModTime())
+	return true
+}
@@ -0,0 +1,13 @@
+//go:build !vips
+
+package main
+
+import "errors"
+
+// avifSupported is false in builds without libvips; avif_enabled then serves the original files
+const avifSupported = false
+
+// transcodeAVIF is unavailable without libvips; build with -tags vips to enable it
+func transcodeAVIF(imagePath string, quality int) ([]byte, error) {
+	return nil, errors.New("AVIF transcoding requires a build with -tags vips")
+}
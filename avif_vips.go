@@ -0,0 +1,39 @@
+//go:build vips
+
+package main
+
+import (
+	"sync"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// avifSupported is true when monikim is built with -tags vips and linked against libvips
+const avifSupported = true
+
+var (
+	vipsStartup    sync.Once
+	vipsStartupErr error
+)
+
+// transcodeAVIF encodes the image file as AVIF with the given quality using libvips
+func transcodeAVIF(imagePath string, quality int) ([]byte, error) {
+	vipsStartup.Do(func() {
+		vips.LoggingSettings(nil, vips.LogLevelWarning)
+		vipsStartupErr = vips.Startup(nil)
+	})
+	if vipsStartupErr != nil {
+		return nil, vipsStartupErr
+	}
+	img, err := vips.NewImageFromFile(imagePath)
+	if err != nil {
+		return nil, err
+	}
+	defer img.Close()
+
+	params := vips.NewAvifExportParams()
+	params.Quality = quality
+	params.StripMetadata = true
+	data, _, err := img.ExportAvif(params)
+	return data, err
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// cachedContent is a generated response body kept in the content cache
+type cachedContent struct {
+	ContentType string
+	Data        []byte
+}
+
+// CachedFile is a cached response body that writes itself in a single Write, skipping the intermediate buffer
+// that copying it through the response writer's ReadFrom would use
+type CachedFile struct {
+	data []byte
+}
+
+// WriteTo writes the cached bytes to w
+func (f CachedFile) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(f.data)
+	return int64(n), err
+}
+
+// serveCachedContent serves content from the content cache. Plain GETs are written straight from the cache through
+// CachedFile; range and conditional requests go through http.ServeContent, whose io.CopyN hides WriterTo.
+func serveCachedContent(w http.ResponseWriter, r *http.Request, content cachedContent, modTime time.Time) {
+	w.Header().Set("Content-Type", content.ContentType)
+	if !isPlainGet(r) {
+		http.ServeContent(w, r, "", modTime, bytes.NewReader(content.Data))
+		return
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(content.Data)))
+	w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	w.Header().Set("Accept-Ranges", "bytes")
+	CachedFile{data: content.Data}.WriteTo(w)
+}
+
+// contentLRU caches transformed images; it is sized from content_cache_size at startup
+var contentLRU = newContentCache(128)
+
+// contentCache is a fixed-size LRU cache of generated response bodies
+type contentCache struct {
+	mu      sync.Mutex
+	maxSize int
+	order   *list.List
+	items   map[string]*list.Element
+}
+
+// contentCacheEntry is the value stored in the LRU list
+type contentCacheEntry struct {
+	key     string
+	content cachedContent
+}
+
+// newContentCache creates a content cache holding at most maxSize entries; a maxSize of 0 caches nothing
+func newContentCache(maxSize int) *contentCache {
+	return &contentCache{
+		maxSize: maxSize,
+		order:   list.New(),
+		items:   make(map[string]*list.Element),
+	}
+}
+
+// Get returns the cached content for key and marks it as recently used
+func (c *contentCache) Get(key string) (cachedContent, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, exists := c.items[key]; exists {
+		c.order.MoveToFront(element)
+		return element.Value.(*contentCacheEntry).content, true
+	}
+	return cachedContent{}, false
+}
+
+// Add stores content under key, evicting the least recently used entry when the cache is full
+func (c *contentCache) Add(key string, content cachedContent) {
+	if c.maxSize <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, exists := c.items[key]; exists {
+		c.order.MoveToFront(element)
+		element.Value.(*contentCacheEntry).content = content
+		return
+	}
+	c.items[key] = c.order.PushFront(&contentCacheEntry{key: key, content: content})
+	for c.order.Len() > c.maxSize {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*contentCacheEntry).key)
+	}
+}
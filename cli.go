@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// runPick implements "monikim pick [--source name]": it prints the absolute path of a randomly selected image
+func runPick(configPaths []string, args []string) int {
+	flags := flag.NewFlagSet("pick", flag.ContinueOnError)
+	source := flags.String("source", "", "source name from param_source_mapping")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	config, err := loadConfig(configPaths...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "\u52a0\u8f7d\u914d\u7f6e\u5931\u8d25: %v\n", err)
+		return 1
+	}
+	if err := prepareConfig(config); err != nil {
+		fmt.Fprintf(os.Stderr, "\u914d\u7f6e\u65e0\u6548: %v\n", err)
+		return 1
+	}
+
+	imageDir := sourceDir(config, *source)
+	if imageDir == "" {
+		fmt.Fprintf(os.Stderr, "unknown source %q\n", *source)
+		return 1
+	}
+	validFiles, err := scanImageFiles(config, imageDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "\u65e0\u6cd5\u8bfb\u53d6\u56fe\u7247\u76ee\u5f55: %v\n", err)
+		return 1
+	}
+	if len(validFiles) == 0 {
+		fmt.Fprintln(os.Stderr, "\u6ca1\u6709\u627e\u5230\u6709\u6548\u7684\u56fe\u7247")
+		return 1
+	}
+
+	path, err := filepath.Abs(validFiles[rand.Intn(len(validFiles))].Path())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	fmt.Println(path)
+	return 0
+}
+
+// runListPresets implements --list-presets: it prints each preset with its description and the settings it changes
+// from the defaults, as a plain text table or, with --output=markdown, as a Markdown table
+func runListPresets(output string) int {
+	switch output {
+	case "text":
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "PRESET\tDESCRIPTION\tSETTINGS")
+		for _, name := range presetNames() {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", name, configPresets[name].Description, strings.Join(presetSettings(configPresets[name].Config()), ", "))
+		}
+		tw.Flush()
+	case "markdown":
+		fmt.Println("| Preset | Description | Settings |")
+		fmt.Println("| --- | --- | --- |")
+		for _, name := range presetNames() {
+			settings := presetSettings(configPresets[name].Config())
+			for i, setting := range settings {
+				settings[i] = "`" + setting + "`"
+			}
+			fmt.Printf("| %s | %s | %s |\n", name, configPresets[name].Description, strings.Join(settings, "<br>"))
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "unknown --output %q, expected text or markdown\n", output)
+		return 2
+	}
+	return 0
+}
+
+// runListSources implements --list-sources: it prints every configured source with its file count.
+// Directories are scanned even if validation would reject them, so broken entries show up in the table.
+func runListSources(configPaths []string) int {
+	config, err := loadConfig(configPaths...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "\u52a0\u8f7d\u914d\u7f6e\u5931\u8d25: %v\n", err)
+		return 1
+	}
+	if err := config.compile(); err != nil {
+		fmt.Fprintf(os.Stderr, "\u914d\u7f6e\u65e0\u6548: %v\n", err)
+		return 1
+	}
+	config.expandImageDirs()
+
+	sources := make([]string, 0, len(config.ParamSourceMapping))
+	for source := range config.ParamSourceMapping {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SOURCE\tDIRECTORY\tFILE_COUNT\tFIRST_FILE\tLAST_FILE")
+	printSource := func(name, dir string) {
+		validFiles, err := scanImageFiles(config, dir)
+		if err != nil {
+			fmt.Fprintf(tw, "%s\t%s\terror: %v\t-\t-\n", name, dir, err)
+			return
+		}
+		first, last := "-", "-"
+		if len(validFiles) > 0 {
+			first, last = validFiles[0].Path(), validFiles[len(validFiles)-1].Path()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\n", name, dir, len(validFiles), first, last)
+	}
+	printSource("(default)", config.ImageDir)
+	for _, source := range sources {
+		printSource(source, config.ParamSourceMapping[source])
+	}
+	tw.Flush()
+	return 0
+}
+
+// runBench implements --bench: it drives handleImageRequest through an httptest.ResponseRecorder for duration
+// and prints throughput, latency and allocations. It returns 2 when the measured RPS is below minRPS.
+func runBench(config *Config, duration time.Duration, minRPS float64) int {
+	if config.Mode == "sse" {
+		fmt.Fprintln(os.Stderr, "bench: sse mode streams forever and cannot be benchmarked")
+		return 0
+	}
+
+	var latencies []time.Duration
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+	for time.Since(start) < duration {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		w := httptest.NewRecorder()
+		t := time.Now()
+		handleImageRequest(w, r, config, config.ImageDir)
+		latencies = append(latencies, time.Since(t))
+	}
+	elapsed := time.Since(start)
+	runtime.ReadMemStats(&after)
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	var total time.Duration
+	for _, latency := range latencies {
+		total += latency
+	}
+	n := len(latencies)
+	rps := float64(n) / elapsed.Seconds()
+	fmt.Printf("RPS: %.0f\n", rps)
+	fmt.Printf("avg latency: %v\n", total/time.Duration(n))
+	fmt.Printf("p99 latency: %v\n", latencies[(n*99+99)/100-1])
+	fmt.Printf("allocs/op: %d\n", (after.Mallocs-before.Mallocs)/uint64(n))
+
+	if rps < minRPS {
+		fmt.Fprintf(os.Stderr, "bench: %.0f RPS is below --bench-min-rps %.0f\n", rps, minRPS)
+		return 2
+	}
+	return 0
+}
+
+// runInit implements --init: it writes config.example.yaml and config.schema.json to the working directory,
+// leaving files that already exist untouched
+func runInit() int {
+	schema, err := json.MarshalIndent(configSchema(), "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	files := []struct {
+		name string
+		data []byte
+	}{
+		{"config.example.yaml", []byte(exampleConfig)},
+		{"config.schema.json", append(schema, '\n')},
+	}
+	for _, file := range files {
+		f, err := os.OpenFile(file.name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		_, err = f.Write(file.data)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		fmt.Println(file.name)
+	}
+	return 0
+}
+
+// runCheckConfig implements --check-config: it validates the syntax and settings of the config without looking at
+// image directories or list files, printing every violation. It returns 1 if there are any. The allowed_origins and
+// allowed_referers rules need the merged list files, so they are only checked when the server starts.
+func runCheckConfig(configPaths []string) int {
+	config, err := loadConfig(configPaths...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "\u52a0\u8f7d\u914d\u7f6e\u5931\u8d25: %v\n", err)
+		return 1
+	}
+	errs := validateFields(config)
+	if err := config.compile(); err != nil {
+		errs = append(errs, err)
+	}
+	for _, err := range errs {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	if len(errs) > 0 {
+		return 1
+	}
+	fmt.Println("\u914d\u7f6e\u6709\u6548")
+	return 0
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRunCheckConfig(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		config string
+		want   int
+	}{
+		{"missing image_dir is not checked", "image_dir: /nonexistent/images\n", 0},
+		{"missing list file is not read", "image_dir: /nonexistent/images\ncors_enabled: true\nallowed_origins_file: /nonexistent/origins.txt\n", 0},
+		{"every violation fails", "image_dir: /nonexistent/images\nmode: bogus\nport: \"70000\"\n", 1},
+		{"bad template fails", "image_dir: /nonexistent/images\nhtml_template: \"{{\"\n", 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(path, []byte(tc.config), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if got := runCheckConfig([]string{path}); got != tc.want {
+				t.Errorf("runCheckConfig = %d, want %d", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import "net/http"
+
+// clientRejection is why a client was refused by geo_block, the user agent rules or the referer check
+type clientRejection struct {
+	Message string
+	Code    string
+}
+
+// checkClient applies geo_block, the user agent rules and the referer check to a client, returning nil when the
+// client may proceed. Every HTTP endpoint and gRPC method goes through it.
+func checkClient(config *Config, clientAddr, userAgent, referer string) *clientRejection {
+	if isGeoBlocked(clientAddr, config) {
+		return &clientRejection{Message: "access not available in your region", Code: "REGION_BLOCKED"}
+	}
+	if isUserAgentBlocked(userAgent, config) {
+		return &clientRejection{Message: "403 Forbidden", Code: "USER_AGENT_BLOCKED"}
+	}
+	if *config.RefererCheckEnabled && !isAllowedReferer(referer, config.AllowedReferers) {
+		return &clientRejection{Message: "403 Forbidden", Code: "REFERER_BLOCKED"}
+	}
+	return nil
+}
+
+// uncheckedPaths are answered to every client: probes and crawlers send no Referer, and a crawler refused
+// /robots.txt would take it as permission to fetch everything. The operator endpoints are called from curl and
+// monitoring rather than pages, and /admin/shutdown is guarded by admin_token instead.
+var uncheckedPaths = map[string]bool{
+	"/health":         true,
+	"/ready":          true,
+	"/robots.txt":     true,
+	"/admin/shutdown": true,
+	"/openapi.yaml":   true,
+	"/schema":         true,
+	"/stats":          true,
+	"/version":        true,
+}
+
+// withClientChecks refuses clients rejected by checkClient with 403 before they reach any endpoint
+func withClientChecks(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !uncheckedPaths[r.URL.Path] {
+			if rejection := checkClient(currentConfig.Load(), clientIP(r), r.UserAgent(), r.Referer()); rejection != nil {
+				writeError(w, http.StatusForbidden, rejection.Message, rejection.Code)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestClientChecksCoverEveryEndpoint(t *testing.T) {
+	dir := setupTestDir(t)
+	config := newTestConfig(t, dir, func(c *Config) {
+		c.Mode = "redirect_signed"
+		c.SigningSecret = "secret"
+		c.ErrorFormat = "json"
+		c.ListEndpointEnabled = boolPtr(true)
+		c.WebSocket = boolPtr(true)
+		c.BlockBadBots = boolPtr(true)
+		c.RefererCheckEnabled = boolPtr(true)
+		c.AllowedReferers = []string{"https://example.com/"}
+	})
+	handler := newTestHandler(t, config)
+	allowed := http.Header{"Referer": {"https://example.com/"}, "User-Agent": {"Mozilla/5.0"}}
+	for _, target := range []string{"/", "/list", "/verify", "/favicon.ico", "/ws"} {
+		for _, tc := range []struct {
+			name   string
+			header http.Header
+			code   string
+		}{
+			{"bad bot", http.Header{"Referer": {"https://example.com/"}, "User-Agent": {"sqlmap/1.7"}}, "USER_AGENT_BLOCKED"},
+			{"foreign referer", http.Header{"Referer": {"https://evil.example/"}, "User-Agent": {"Mozilla/5.0"}}, "REFERER_BLOCKED"},
+		} {
+			w := serve(handler, http.MethodGet, target, tc.header)
+			if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), tc.code) {
+				t.Errorf("%s from a %s = %d %q, want 403 %s", target, tc.name, w.Code, w.Body, tc.code)
+			}
+		}
+		if w := serve(handler, http.MethodGet, target, allowed); w.Code == http.StatusForbidden {
+			t.Errorf("%s from an allowed client = 403: %s", target, w.Body)
+		}
+	}
+	for _, target := range []string{"/health", "/ready", "/robots.txt"} {
+		if w := serve(handler, http.MethodGet, target, http.Header{"User-Agent": {"sqlmap/1.7"}}); w.Code != http.StatusOK {
+			t.Errorf("%s from a bad bot without Referer = %d, want 200", target, w.Code)
+		}
+	}
+}
+
+func TestClientChecksSkipOperatorEndpoints(t *testing.T) {
+	config := newTestConfig(t, setupTestDir(t), func(c *Config) {
+		c.ErrorFormat = "json"
+		c.AdminToken = "token"
+		c.StatsEndpointEnabled = boolPtr(true)
+		c.VersionEndpointEnabled = boolPtr(true)
+		c.SchemaEndpointEnabled = boolPtr(true)
+		c.RefererCheckEnabled = boolPtr(true)
+		c.AllowedReferers = []string{"https://example.com/"}
+	})
+	handler := newTestHandler(t, config)
+	// curl sends neither a Referer nor a browser user agent
+	curl := http.Header{"User-Agent": {"curl/8.5.0"}}
+	for _, target := range []string{"/openapi.yaml", "/schema", "/stats", "/version"} {
+		if w := serve(handler, http.MethodGet, target, curl); w.Code != http.StatusOK {
+			t.Errorf("GET %s from curl with referer_check_enabled = %d, want 200: %s", target, w.Code, w.Body)
+		}
+	}
+	// A wrong token reaches the admin_token check instead of being refused for the missing Referer
+	if w := serve(handler, http.MethodPost, "/admin/shutdown", curl); !strings.Contains(w.Body.String(), "INVALID_TOKEN") {
+		t.Errorf("POST /admin/shutdown from curl = %d %q, want the INVALID_TOKEN rejection", w.Code, w.Body)
+	}
+	if w := serve(handler, http.MethodGet, "/", curl); w.Code != http.StatusForbidden {
+		t.Errorf("GET / from curl with referer_check_enabled = %d, want 403", w.Code)
+	}
+}
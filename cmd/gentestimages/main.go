@@ -0,0 +1,157 @@
+// gentestimages writes small solid-colour JPEG, PNG, GIF and WebP images to use as test fixtures,
+// so the fixture set can be regenerated instead of committing binary files.
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// size is the width and height of every generated image
+const size = 8
+
+// encoders maps each generated file extension to its encoder
+var encoders = []struct {
+	ext    string
+	encode func(io.Writer, image.Image) error
+}{
+	{".jpg", func(w io.Writer, img image.Image) error { return jpeg.Encode(w, img, &jpeg.Options{Quality: 90}) }},
+	{".png", png.Encode},
+	{".gif", encodeGIF},
+	{".webp", encodeWebP},
+}
+
+func main() {
+	count := flag.Int("count", 4, "number of images to generate per format")
+	dir := flag.String("dir", "testdata", "directory to write the images to")
+	flag.Parse()
+
+	if *count < 1 {
+		fmt.Fprintln(os.Stderr, "--count must be at least 1")
+		os.Exit(2)
+	}
+	if err := os.MkdirAll(*dir, 0755); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	for i := 0; i < *count; i++ {
+		for j, enc := range encoders {
+			name := filepath.Join(*dir, fmt.Sprintf("image-%03d%s", i, enc.ext))
+			if err := writeImage(name, solid(colorFor(i*len(encoders)+j)), enc.encode); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+				os.Exit(1)
+			}
+		}
+	}
+	fmt.Printf("wrote %d images to %s\n", *count*len(encoders), *dir)
+}
+
+// colorFor returns a distinct opaque colour for every index below 1<<24
+func colorFor(index int) color.RGBA {
+	// Multiplying by an odd constant is a bijection modulo 1<<24 and spreads neighbouring indexes apart
+	v := uint32(index) * 0x9E3779 & 0xFFFFFF
+	return color.RGBA{R: uint8(v >> 16), G: uint8(v >> 8), B: uint8(v), A: 0xFF}
+}
+
+// solid returns a size\u00d7size image filled with c
+func solid(c color.RGBA) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	draw.Draw(img, img.Bounds(), image.NewUniform(c), image.Point{}, draw.Src)
+	return img
+}
+
+// writeImage encodes img into the file name, replacing any existing file
+func writeImage(name string, img image.Image, encode func(io.Writer, image.Image) error) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if err := encode(f, img); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// encodeGIF encodes a solid-colour img as a GIF whose palette is that single colour
+func encodeGIF(w io.Writer, img image.Image) error {
+	bounds := img.Bounds()
+	// Every pixel of a new Paletted image is index 0, the image's colour
+	paletted := image.NewPaletted(bounds, color.Palette{img.At(bounds.Min.X, bounds.Min.Y)})
+	return gif.Encode(w, paletted, nil)
+}
+
+// encodeWebP encodes a solid-colour img as a lossless (VP8L) WebP. The standard library and x/image only
+// decode WebP, but a single colour needs no real entropy coding: each of the five prefix codes is a
+// "simple code" with one symbol, which takes zero bits per pixel.
+func encodeWebP(w io.Writer, img image.Image) error {
+	bounds := img.Bounds()
+	r, g, b, a := img.At(bounds.Min.X, bounds.Min.Y).RGBA()
+
+	var bw bitWriter
+	bw.write(0x2f, 8) // VP8L signature
+	bw.write(uint32(bounds.Dx()-1), 14)
+	bw.write(uint32(bounds.Dy()-1), 14)
+	bw.write(0, 1) // alpha_is_used: the images are opaque
+	bw.write(0, 3) // version
+	bw.write(0, 1) // no transforms
+	bw.write(0, 1) // no colour cache
+	bw.write(0, 1) // no meta prefix codes
+	// Prefix codes for green, red, blue, alpha and distance
+	for _, symbol := range []uint32{g >> 8, r >> 8, b >> 8, a >> 8, 0} {
+		bw.write(1, 1) // simple code
+		bw.write(0, 1) // one symbol
+		bw.write(1, 1) // 8-bit symbol
+		bw.write(symbol, 8)
+	}
+	data := bw.bytes()
+
+	var buf bytes.Buffer
+	buf.WriteString("RIFF")
+	riffSize := 4 + 8 + len(data) + len(data)%2
+	binary.Write(&buf, binary.LittleEndian, uint32(riffSize))
+	buf.WriteString("WEBPVP8L")
+	binary.Write(&buf, binary.LittleEndian, uint32(len(data)))
+	buf.Write(data)
+	if len(data)%2 == 1 {
+		buf.WriteByte(0)
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// bitWriter packs values least significant bit first, as VP8L expects
+type bitWriter struct {
+	buf   []byte
+	acc   uint64
+	nbits uint
+}
+
+func (bw *bitWriter) write(v uint32, n uint) {
+	bw.acc |= uint64(v&(1<<n-1)) << bw.nbits
+	bw.nbits += n
+	for bw.nbits >= 8 {
+		bw.buf = append(bw.buf, byte(bw.acc))
+		bw.acc >>= 8
+		bw.nbits -= 8
+	}
+}
+
+func (bw *bitWriter) bytes() []byte {
+	if bw.nbits > 0 {
+		bw.buf = append(bw.buf, byte(bw.acc))
+		bw.acc, bw.nbits = 0, 0
+	}
+	return bw.buf
+}
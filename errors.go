@@ -0,0 +1,85 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"net/http"
+)
+
+//go:embed templates/error.html
+var errorHTML string
+
+// errorTemplate renders error responses in the "html" error_format
+var errorTemplate = htmltemplate.Must(htmltemplate.New("error").Parse(errorHTML))
+
+// knownErrorFormats lists the accepted error_format values
+var knownErrorFormats = map[string]bool{"text": true, "json": true, "html": true}
+
+// writeError responds with statusCode and message in the configured error_format; code is a machine readable
+// identifier such as "REFERER_BLOCKED" that the json and html formats include
+func writeError(w http.ResponseWriter, statusCode int, message, code string) {
+	format := "text"
+	if config := currentConfig.Load(); config != nil {
+		format = config.ErrorFormat
+	}
+	writeErrorAs(w, format, statusCode, message, code)
+}
+
+// writeErrorAs responds with an error in the given format; unknown formats fall back to text
+func writeErrorAs(w http.ResponseWriter, format string, statusCode int, message, code string) {
+	w.Header().Del("Content-Length")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	switch format {
+	case "json":
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(statusCode)
+		json.NewEncoder(w).Encode(map[string]string{"error": message, "code": code})
+	case "html":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(statusCode)
+		errorTemplate.Execute(w, map[string]interface{}{
+			"Status":     statusCode,
+			"StatusText": http.StatusText(statusCode),
+			"Message":    message,
+			"Code":       code,
+		})
+	default:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(statusCode)
+		fmt.Fprintln(w, message)
+	}
+}
+
+// SensitiveError is an error whose details, such as file system paths or config URLs, must not reach clients.
+// Error returns only the public message; the full error is available through Internal for logs.
+type SensitiveError struct {
+	public string
+	err    error
+}
+
+// newSensitiveError wraps err behind the public message
+func newSensitiveError(public string, err error) *SensitiveError {
+	return &SensitiveError{public: public, err: err}
+}
+
+// Public returns the message that is safe to show to clients
+func (e *SensitiveError) Public() string {
+	return e.public
+}
+
+// Internal returns the full error, for logs only
+func (e *SensitiveError) Internal() string {
+	return fmt.Sprintf("%s: %v", e.public, e.err)
+}
+
+// Error returns the public message, so logging or printing the error never discloses the details
+func (e *SensitiveError) Error() string {
+	return e.public
+}
+
+// Unwrap returns the wrapped error, keeping it reachable for errors.Is and errors.As
+func (e *SensitiveError) Unwrap() error {
+	return e.err
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"strings"
+	"testing"
+)
+
+func TestSensitiveError(t *testing.T) {
+	err := newSensitiveError("config unreadable", &fs.PathError{Op: "open", Path: "/etc/monikim/secret.yaml", Err: fs.ErrPermission})
+	if err.Error() != "config unreadable" || strings.Contains(err.Error(), "/etc/monikim") {
+		t.Errorf("Error() = %q, want only the public message", err.Error())
+	}
+	if !strings.Contains(err.Internal(), "/etc/monikim/secret.yaml") {
+		t.Errorf("Internal() = %q, want the wrapped details", err.Internal())
+	}
+	if !errors.Is(err, fs.ErrPermission) {
+		t.Error("errors.Is does not reach the wrapped error")
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+// GeoBlockConfig restricts access by the country of the client IP, looked up in a MaxMind GeoIP2 country database
+type GeoBlockConfig struct {
+	Enabled          *bool    `yaml:"enabled"`
+	DBPath           string   `yaml:"db_path"`
+	BlockedCountries []string `yaml:"blocked_countries"`
+	AllowedCountries []string `yaml:"allowed_countries"`
+}
+
+// geoDB is the country database opened at startup when geo_block is enabled
+var geoDB *geoip2.Reader
+
+// clientIP returns the IP address of the client that sent r
+func clientIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// isGeoBlocked reports whether the country of the client IP is outside allowed_countries (when set) or in
+// blocked_countries. Clients whose country cannot be determined are let through.
+func isGeoBlocked(clientAddr string, config *Config) bool {
+	if !*config.GeoBlock.Enabled || geoDB == nil {
+		return false
+	}
+	ip := net.ParseIP(clientAddr)
+	if ip == nil {
+		return false
+	}
+	record, err := geoDB.Country(ip)
+	if err != nil || record.Country.IsoCode == "" {
+		return false
+	}
+	country := record.Country.IsoCode
+
+	blocked := containsFold(config.GeoBlock.BlockedCountries, country)
+	if len(config.GeoBlock.AllowedCountries) > 0 && !containsFold(config.GeoBlock.AllowedCountries, country) {
+		blocked = true
+	}
+	if blocked {
+		server.logger().Info("request blocked by region", slog.String("ip", ip.String()), slog.String("country", country))
+	} else {
+		server.logger().Debug("request country", slog.String("ip", ip.String()), slog.String("country", country))
+	}
+	return blocked
+}
+
+// containsFold checks if a slice contains a given element, ignoring case
+func containsFold(slice []string, item string) bool {
+	for _, element := range slice {
+		if strings.EqualFold(element, item) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,23 @@
+module github.com/Bryant-Xue/monikim
+
+go 1.22.7
+
+require (
+	github.com/davidbyttow/govips/v2 v2.16.0
+	github.com/fsnotify/fsnotify v1.7.0
+	github.com/gorilla/websocket v1.5.3
+	github.com/oschwald/geoip2-golang v1.11.0
+	golang.org/x/image v0.20.0
+	golang.org/x/sync v0.8.0
+	google.golang.org/grpc v1.68.0
+	google.golang.org/protobuf v1.34.2
+	gopkg.in/yaml.v2 v2.4.0
+)
+
+require (
+	github.com/oschwald/maxminddb-golang v1.13.0 // indirect
+	golang.org/x/net v0.29.0 // indirect
+	golang.org/x/sys v0.25.0 // indirect
+	golang.org/x/text v0.18.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20240903143218-8af14fe29dc1 // indirect
+)
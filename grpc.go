@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+
+	monikimpb "github.com/Bryant-Xue/monikim/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// grpcServer implements the MoniKim gRPC service on top of the current config
+type grpcServer struct {
+	monikimpb.UnimplementedMoniKimServer
+}
+
+// GetRandomImage picks an image from the requested source; a non-zero seed makes the pick deterministic
+func (grpcServer) GetRandomImage(ctx context.Context, req *monikimpb.GetImageRequest) (*monikimpb.GetImageResponse, error) {
+	config := currentConfig.Load()
+	imageDir := sourceDir(config, req.GetSource())
+	if imageDir == "" {
+		return nil, status.Errorf(codes.NotFound, "unknown source %q", req.GetSource())
+	}
+
+	validFiles, err := server.scan(config, imageDir)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "\u65e0\u6cd5\u8bfb\u53d6\u56fe\u7247\u76ee\u5f55: %v", err)
+	}
+	if len(validFiles) == 0 {
+		return nil, status.Error(codes.NotFound, "\u6ca1\u6709\u627e\u5230\u6709\u6548\u7684\u56fe\u7247")
+	}
+
+	var selected imageFile
+	if seed := req.GetSeed(); seed != 0 {
+		selected = validFiles[rand.New(rand.NewSource(seed)).Intn(len(validFiles))]
+	} else {
+		selected = validFiles[rand.Intn(len(validFiles))]
+	}
+
+	resp := &monikimpb.GetImageResponse{
+		Filename:  filepath.Base(selected.Path()),
+		Url:       imageURL(config, selected.Path()),
+		SizeBytes: selected.Size,
+	}
+	if req.GetIncludeData() {
+		data, err := os.ReadFile(selected.Path())
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "%v", err)
+		}
+		resp.Data = data
+	}
+	return resp, nil
+}
+
+// checkGRPCClient applies checkClient to the peer of a gRPC call, reading the user agent and referer from its metadata
+func checkGRPCClient(ctx context.Context) error {
+	var clientAddr, userAgent, referer string
+	if p, ok := peer.FromContext(ctx); ok {
+		clientAddr = p.Addr.String()
+		if host, _, err := net.SplitHostPort(clientAddr); err == nil {
+			clientAddr = host
+		}
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get("user-agent"); len(values) > 0 {
+			userAgent = values[0]
+		}
+		if values := md.Get("referer"); len(values) > 0 {
+			referer = values[0]
+		}
+	}
+	if rejection := checkClient(currentConfig.Load(), clientAddr, userAgent, referer); rejection != nil {
+		return status.Errorf(codes.PermissionDenied, "%s (%s)", rejection.Message, rejection.Code)
+	}
+	return nil
+}
+
+// unaryClientCheck refuses unary calls from clients rejected by checkClient
+func unaryClientCheck(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if err := checkGRPCClient(ctx); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// streamClientCheck refuses streams from clients rejected by checkClient
+func streamClientCheck(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := checkGRPCClient(ss.Context()); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
+
+// newGRPCServer returns a gRPC server with the MoniKim service registered behind the client checks
+func newGRPCServer() *grpc.Server {
+	grpcSrv := grpc.NewServer(grpc.UnaryInterceptor(unaryClientCheck), grpc.StreamInterceptor(streamClientCheck))
+	monikimpb.RegisterMoniKimServer(grpcSrv, grpcServer{})
+	return grpcSrv
+}
+
+// serveGRPC serves the MoniKim gRPC service on port until the listener fails
+func serveGRPC(port string) error {
+	listener, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		return err
+	}
+	grpcSrv := newGRPCServer()
+	server.logger().Info("gRPC \u670d\u52a1\u6b63\u5728\u542f\u52a8", slog.String("port", port))
+	if err := grpcSrv.Serve(listener); err != nil && !errors.Is(err, grpc.ErrServerStopped) {
+		return err
+	}
+	return nil
+}
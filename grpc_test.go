@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	monikimpb "github.com/Bryant-Xue/monikim/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// dialTestGRPC serves newGRPCServer on a loopback port for the duration of the test and returns a client for it
+func dialTestGRPC(t *testing.T, opts ...grpc.DialOption) monikimpb.MoniKimClient {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	grpcSrv := newGRPCServer()
+	go grpcSrv.Serve(listener)
+	t.Cleanup(grpcSrv.Stop)
+
+	conn, err := grpc.NewClient(listener.Addr().String(), append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return monikimpb.NewMoniKimClient(conn)
+}
+
+func TestGRPCClientChecks(t *testing.T) {
+	config := newTestConfig(t, setupTestDir(t), func(c *Config) {
+		c.BlockBadBots = boolPtr(true)
+		c.RefererCheckEnabled = boolPtr(true)
+		c.AllowedReferers = []string{"https://example.com/"}
+	})
+	useConfig(t, config)
+	allowed := metadata.AppendToOutgoingContext(context.Background(), "referer", "https://example.com/")
+
+	if _, err := dialTestGRPC(t).GetRandomImage(allowed, &monikimpb.GetImageRequest{}); err != nil {
+		t.Errorf("allowed client: %v", err)
+	}
+	bot := dialTestGRPC(t, grpc.WithUserAgent("sqlmap/1.7"))
+	if _, err := bot.GetRandomImage(allowed, &monikimpb.GetImageRequest{}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("bad bot: %v, want PermissionDenied", err)
+	}
+	foreign := metadata.AppendToOutgoingContext(context.Background(), "referer", "https://evil.example/")
+	if _, err := dialTestGRPC(t).GetRandomImage(foreign, &monikimpb.GetImageRequest{}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("foreign referer: %v, want PermissionDenied", err)
+	}
+}
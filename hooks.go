@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// PreSelectHook can filter or reorder the candidate image paths before one is picked
+type PreSelectHook func(r *http.Request, candidates []string) []string
+
+// PostSelectHook can inspect or replace the selected image path
+type PostSelectHook func(r *http.Request, selected string) string
+
+// applyPreSelect runs the pre-select hooks over the pool and returns the files that remain
+func (s *Server) applyPreSelect(r *http.Request, validFiles []imageFile) []imageFile {
+	if len(s.PreSelectHooks) == 0 {
+		return validFiles
+	}
+	byPath := make(map[string]imageFile, len(validFiles))
+	candidates := make([]string, len(validFiles))
+	for i, file := range validFiles {
+		candidates[i] = file.Path()
+		byPath[candidates[i]] = file
+	}
+	for _, hook := range s.PreSelectHooks {
+		candidates = hook(r, candidates)
+	}
+
+	filtered := make([]imageFile, 0, len(candidates))
+	for _, path := range candidates {
+		if file, exists := byPath[path]; exists {
+			filtered = append(filtered, file)
+		}
+	}
+	return filtered
+}
+
+// applyPostSelect runs the post-select hooks; a hook may substitute any existing file
+func (s *Server) applyPostSelect(r *http.Request, selected imageFile) imageFile {
+	for _, hook := range s.PostSelectHooks {
+		path := hook(r, selected.Path())
+		if path == selected.Path() {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil || info.IsDir() {
+			continue
+		}
+		selected = imageFile{Dir: filepath.Dir(path), Entry: fs.FileInfoToDirEntry(info), ModTime: info.ModTime(), Size: info.Size()}
+	}
+	return selected
+}
+
+// LoggingHook logs every selected image at info level
+func LoggingHook(r *http.Request, selected string) string {
+	server.logger().Info("image selected", slog.String("path", r.URL.Path), slog.String("selected_file", selected))
+	return selected
+}
+
+// FilterBySizeHook keeps only candidates whose size is within [minBytes, maxBytes]; maxBytes <= 0 means no upper limit
+func FilterBySizeHook(minBytes, maxBytes int64) PreSelectHook {
+	return func(r *http.Request, candidates []string) []string {
+		filtered := candidates[:0:0]
+		for _, path := range candidates {
+			info, err := os.Stat(path)
+			if err != nil {
+				continue
+			}
+			if info.Size() >= minBytes && (maxBytes <= 0 || info.Size() <= maxBytes) {
+				filtered = append(filtered, path)
+			}
+		}
+		return filtered
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// listedImage is one entry of the /list response
+type listedImage struct {
+	Name      string `json:"name"`
+	URL       string `json:"url"`
+	SizeBytes int64  `json:"size_bytes"`
+}
+
+// handleList responds with the images of a source as JSON. Its Last-Modified is the newest modification time of the
+// files and of the directories holding them, so adding or removing a file changes it too.
+func handleList(w http.ResponseWriter, r *http.Request, config *Config) {
+	imageDir := resolveImageDir(r, config)
+	if imageDir == "" {
+		writeUnknownSource(w, r)
+		return
+	}
+	validFiles, err := server.scan(config, imageDir)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "\u65e0\u6cd5\u8bfb\u53d6\u56fe\u7247\u76ee\u5f55", "READ_DIR_FAILED")
+		return
+	}
+
+	var lastModified time.Time
+	for _, dir := range config.dirsFor(imageDir) {
+		if info, err := os.Stat(dir); err == nil && info.ModTime().After(lastModified) {
+			lastModified = info.ModTime()
+		}
+	}
+	images := make([]listedImage, 0, len(validFiles))
+	for _, file := range validFiles {
+		if file.ModTime.After(lastModified) {
+			lastModified = file.ModTime
+		}
+		images = append(images, listedImage{Name: filepath.Base(file.Path()), URL: imageURL(config, file.Path()), SizeBytes: file.Size})
+	}
+
+	// HTTP dates have a resolution of one second
+	lastModified = lastModified.UTC().Truncate(time.Second)
+	w.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+	if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !lastModified.After(since) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(images)
+}
@@ -1,161 +1,2193 @@
-package main
-
-import (
-	"flag"
-	"fmt"
-	"log"
-	"math/rand"
-	"net/http"
-	"os"
-	"path/filepath"
-	"time"
-
-	"gopkg.in/yaml.v2"
-)
-
-// Config represents the configuration for the server
-type Config struct {
-	Port                 string            `yaml:"port"`
-	ImageDir             string            `yaml:"image_dir"`
-	AllowedExtensions    []string          `yaml:"allowed_extensions"`
-	DisableFileTypeCheck bool              `yaml:"disable_file_type_check"`
-	FaviconPath          string            `yaml:"favicon_path"`
-	CorsEnabled          bool              `yaml:"cors_enabled"`
-	AllowedOrigins       []string          `yaml:"allowed_origins"`
-	AllowedMethods       []string          `yaml:"allowed_methods"`
-	AllowedHeaders       []string          `yaml:"allowed_headers"`
-	Mode                 string            `yaml:"mode"`
-	RefererCheckEnabled  bool              `yaml:"referer_check_enabled"`
-	AllowedReferers      []string          `yaml:"allowed_referers"`
-	ParamSourceMapping   map[string]string `yaml:"param_source_mapping"`
-}
-
-// loadConfig loads configuration from the specified YAML file
-func loadConfig(configPath string) (*Config, error) {
-	file, err := os.Open(configPath)
-	if err != nil {
-		return nil, fmt.Errorf("\u65e0\u6cd5\u8bfb\u53d6\u914d\u7f6e\u6587\u4ef6: %v", err)
-	}
-	defer file.Close()
-
-	var config Config
-	if err := yaml.NewDecoder(file).Decode(&config); err != nil {
-		return nil, fmt.Errorf("\u89e3\u6790\u914d\u7f6e\u6587\u4ef6\u51fa\u9519: %v", err)
-	}
-
-	return &config, nil
-}
-
-// handleCORS sets the appropriate CORS headers based on the config
-func handleCORS(w http.ResponseWriter, r *http.Request, config *Config) {
-	if config.CorsEnabled {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		if len(config.AllowedOrigins) > 0 {
-			origin := r.Header.Get("Origin")
-			for _, allowedOrigin := range config.AllowedOrigins {
-				if allowedOrigin == "*" || allowedOrigin == origin {
-					w.Header().Set("Access-Control-Allow-Origin", allowedOrigin)
-					break
-				}
-			}
-		}
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST")
-		if len(config.AllowedMethods) > 0 {
-			w.Header().Set("Access-Control-Allow-Methods", fmt.Sprintf("%s", config.AllowedMethods))
-		}
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
-		if len(config.AllowedHeaders) > 0 {
-			w.Header().Set("Access-Control-Allow-Headers", fmt.Sprintf("%s", config.AllowedHeaders))
-		}
-	}
-}
-
-// isValidExtension checks if the file extension is valid
-func isValidExtension(fileName string, allowedExtensions []string) bool {
-	ext := filepath.Ext(fileName)
-	for _, allowed := range allowedExtensions {
-		if ext == allowed {
-			return true
-		}
-	}
-	return false
-}
-
-// serveImageRedirect redirects to the image URL instead of serving it directly
-func serveImageRedirect(w http.ResponseWriter, imagePath string) {
-	http.Redirect(w, &http.Request{}, imagePath, http.StatusFound)
-}
-
-// serveImageFile serves the specified image file
-func serveImageFile(w http.ResponseWriter, imagePath string) {
-	http.ServeFile(w, &http.Request{}, imagePath)
-}
-
-// contains checks if a slice contains a given element
-func contains(slice []string, item string) bool {
-	for _, element := range slice {
-		if element == item {
-			return true
-		}
-	}
-	return false
-}
-
-// handleImageRequest processes the image request logic
-func handleImageRequest(w http.ResponseWriter, r *http.Request, config *Config, imageDir string) {
-	files, err := os.ReadDir(imageDir)
-	if err != nil {
-		http.Error(w, "\u65e0\u6cd5\u8bfb\u53d6\u56fe\u7247\u76ee\u5f55", http.StatusInternalServerError)
-		return
-	}
-
-	var validFiles []os.DirEntry
-	for _, file := range files {
-		if !file.IsDir() && (config.DisableFileTypeCheck || isValidExtension(file.Name(), config.AllowedExtensions)) {
-			validFiles = append(validFiles, file)
-		}
-	}
-
-	if len(validFiles) == 0 {
-		http.Error(w, "\u6ca1\u6709\u627e\u5230\u6709\u6548\u7684\u56fe\u7247", http.StatusNotFound)
-		return
-	}
-
-	rand.Seed(time.Now().UnixNano())
-	selectedFile := validFiles[rand.Intn(len(validFiles))]
-	imagePath := filepath.Join(imageDir, selectedFile.Name())
-	if config.Mode == "redir" {
-		serveImageRedirect(w, imagePath)
-	} else {
-		serveImageFile(w, imagePath)
-	}
-}
-
-// main is the entry point of the application
-func main() {
-	flag.Parse()
-
-	config, err := loadConfig("config.yaml")
-	if err != nil {
-		log.Fatalf("\u52a0\u8f7d\u914d\u7f6e\u5931\u8d25: %v", err)
-	}
-
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		param := r.URL.Query().Get("source")
-		imageDir := config.ImageDir
-		if customDir, exists := config.ParamSourceMapping[param]; exists {
-			imageDir = customDir
-		}
-		referer := r.Referer()
-		if config.RefererCheckEnabled && !contains(config.AllowedReferers, referer) {
-			http.Error(w, "403 Forbidden", http.StatusForbidden)
-			return
-		}
-		handleImageRequest(w, r, config, imageDir)
-	})
-
-	log.Printf("\u670d\u52a1\u5668\u6b63\u5728\u7aef\u53e3 %s \u542f\u52a8...", config.Port)
-	if err := http.ListenAndServe(":"+config.Port, nil); err != nil {
-		log.Fatalf("\u670d\u52a1\u5668\u542f\u52a8\u5931\u8d25: %v", err)
-	}
-}
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"io/fs"
+	"log/slog"
+	"math/rand"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	"github.com/oschwald/geoip2-golang"
+	"gopkg.in/yaml.v2"
+)
+
+// Build information, injected at build time via -ldflags "-X main.version=... -X main.buildTime=..."
+var (
+	version   = "dev"
+	buildTime = "unknown"
+)
+
+// Config represents the configuration for the server
+type Config struct {
+	Port                                string               `yaml:"port"`
+	ImageDir                            string               `yaml:"image_dir"`
+	AllowedExtensions                   []string             `yaml:"allowed_extensions"`
+	DisableFileTypeCheck                *bool                `yaml:"disable_file_type_check"`
+	CaseSensitiveExtensions             *bool                `yaml:"case_sensitive_extensions"`
+	FaviconPath                         string               `yaml:"favicon_path"`
+	CorsEnabled                         *bool                `yaml:"cors_enabled"`
+	AllowedOrigins                      []string             `yaml:"allowed_origins"`
+	AllowedMethods                      []string             `yaml:"allowed_methods"`
+	AllowedHeaders                      []string             `yaml:"allowed_headers"`
+	Mode                                string               `yaml:"mode"`
+	RefererCheckEnabled                 *bool                `yaml:"referer_check_enabled"`
+	AllowedReferers                     []string             `yaml:"allowed_referers"`
+	ParamSourceMapping                  map[string]string    `yaml:"param_source_mapping"`
+	ServerHeader                        string               `yaml:"server_header"`
+	VersionEndpointEnabled              *bool                `yaml:"version_endpoint_enabled"`
+	SessionTTL                          time.Duration        `yaml:"session_ttl"`
+	SessionGCInterval                   time.Duration        `yaml:"session_gc_interval"`
+	SigningSecret                       string               `yaml:"signing_secret"`
+	SignedURLTTL                        time.Duration        `yaml:"signed_url_ttl"`
+	SSEInterval                         time.Duration        `yaml:"sse_interval"`
+	Favicons                            map[string]string    `yaml:"favicons"`
+	LogLevel                            string               `yaml:"log_level"`
+	MaxConcurrentRequests               *int                 `yaml:"max_concurrent_requests"`
+	AccessLog                           string               `yaml:"access_log"`
+	AccessLogFormat                     string               `yaml:"access_log_format"`
+	Placeholder                         *bool                `yaml:"placeholder"`
+	PlaceholderWidth                    *int                 `yaml:"placeholder_width"`
+	PlaceholderHeight                   *int                 `yaml:"placeholder_height"`
+	RobotsTxt                           string               `yaml:"robots_txt"`
+	AllowQueryResize                    *bool                `yaml:"allow_query_resize"`
+	MaxResizeWidth                      *int                 `yaml:"max_resize_width"`
+	MaxResizeHeight                     *int                 `yaml:"max_resize_height"`
+	MaxDecodePixels                     *int                 `yaml:"max_decode_pixels"`
+	ContentCacheSize                    *int                 `yaml:"content_cache_size"`
+	AllowedReferersFile                 string               `yaml:"allowed_referers_file"`
+	AllowedOriginsFile                  string               `yaml:"allowed_origins_file"`
+	ConfigWatchEnabled                  *bool                `yaml:"config_watch_enabled"`
+	BaseURL                             string               `yaml:"base_url"`
+	HTMLTemplate                        string               `yaml:"html_template"`
+	CSSProperty                         string               `yaml:"css_property"`
+	CSSSelector                         string               `yaml:"css_selector"`
+	XSLTPath                            string               `yaml:"xslt_path"`
+	StrictSourceMode                    *bool                `yaml:"strict_source_mode"`
+	StatsEndpointEnabled                *bool                `yaml:"stats_endpoint_enabled"`
+	GRPCPort                            string               `yaml:"grpc_port"`
+	SchemaEndpointEnabled               *bool                `yaml:"schema_endpoint_enabled"`
+	XRobotsTag                          *string              `yaml:"x_robots_tag"`
+	ManifestFile                        string               `yaml:"manifest_file"`
+	ListEndpointEnabled                 *bool                `yaml:"list_endpoint_enabled"`
+	HandlerPath                         string               `yaml:"handler_path"`
+	SuppressDisableFileTypeCheckWarning *bool                `yaml:"suppress_disable_file_type_check_warning"`
+	AdminToken                          string               `yaml:"admin_token"`
+	ShutdownTimeout                     time.Duration        `yaml:"shutdown_timeout"`
+	MaxBatchSize                        *int                 `yaml:"max_batch_size"`
+	SourceExtensions                    map[string][]string  `yaml:"source_extensions"`
+	ContentTypeSniff                    *bool                `yaml:"content_type_sniff"`
+	ExposedHeaders                      []string             `yaml:"exposed_headers"`
+	ErrorFormat                         string               `yaml:"error_format"`
+	GeoBlock                            GeoBlockConfig       `yaml:"geo_block"`
+	BlockedUserAgents                   []string             `yaml:"blocked_user_agents"`
+	BlockedUserAgentPatterns            []string             `yaml:"blocked_user_agent_patterns"`
+	AllowedUserAgents                   []string             `yaml:"allowed_user_agents"`
+	BlockBadBots                        *bool                `yaml:"block_bad_bots"`
+	AVIFEnabled                         *bool                `yaml:"avif_enabled"`
+	AVIFQuality                         *int                 `yaml:"avif_quality"`
+	ThumbnailWidth                      *int                 `yaml:"thumbnail_width"`
+	ThumbnailHeight                     *int                 `yaml:"thumbnail_height"`
+	ThumbnailCacheDir                   string               `yaml:"thumbnail_cache_dir"`
+	ThumbnailCleanupInterval            time.Duration        `yaml:"thumbnail_cleanup_interval"`
+	Recommendation                      RecommendationConfig `yaml:"recommendation"`
+	WebSocket                           *bool                `yaml:"websocket"`
+	WSPushInterval                      time.Duration        `yaml:"ws_push_interval"`
+	MaxWSConnections                    *int                 `yaml:"max_ws_connections"`
+	Preset                              string               `yaml:"preset"`
+	AllowCredentials                    *bool                `yaml:"allow_credentials"`
+	MaxHeaderBytes                      *int                 `yaml:"max_header_bytes"`
+	DisableKeepAlives                   *bool                `yaml:"disable_keep_alives"`
+
+	// imageDirs holds the directories matched by glob patterns in image_dir and param_source_mapping
+	imageDirs map[string][]string
+	// htmlTemplate is the parsed html_template
+	htmlTemplate *htmltemplate.Template
+	// allowedExtSet is the lookup set of allowed_extensions, lower-cased unless extensions are case-sensitive
+	allowedExtSet map[string]struct{}
+	// dirExtSets holds the source_extensions lookup sets keyed by the source's directory
+	dirExtSets map[string]map[string]struct{}
+	// manifests caches the parsed manifest_file of each directory; a new config starts empty, so SIGHUP rereads them
+	manifests *sync.Map
+	// sniffedTypes caches the content type sniffed for extension-less files, keyed by path
+	sniffedTypes *sync.Map
+	// userAgentPatterns holds the compiled blocked_user_agent_patterns, plus badBotPattern when block_bad_bots is set
+	userAgentPatterns []*regexp.Regexp
+	// sourcePatterns holds the glob keys of param_source_mapping in the sorted order they are matched in
+	sourcePatterns []string
+}
+
+// defaultHTMLTemplate is the snippet returned in html mode when html_template is not set
+const defaultHTMLTemplate = `<img src="{{.URL}}" alt="{{.Filename}}" loading="lazy">`
+
+// newLogger creates a structured logger for the configured log level
+func newLogger(level string) *slog.Logger {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		lvl = slog.LevelInfo
+	}
+	return slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: lvl}))
+}
+
+// fatal logs msg with err at error level and exits; it is used for startup failures
+func fatal(msg string, err error) {
+	server.logger().Error(msg, slog.Any("error", err))
+	os.Exit(1)
+}
+
+// loadConfig loads configuration from the specified YAML files, see loadConfigWithContext
+func loadConfig(configPaths ...string) (*Config, error) {
+	return loadConfigWithContext(context.Background(), configPaths...)
+}
+
+// configSearchPaths returns the config files looked up when neither --config nor MONIKIM_CONFIG is given,
+// lowest priority first: /etc/monikim, ~/.config/monikim, $XDG_CONFIG_HOME/monikim and the working directory
+func configSearchPaths() []string {
+	paths := []string{"/etc/monikim/config.yaml"}
+	if home, err := os.UserHomeDir(); err == nil {
+		paths = append(paths, filepath.Join(home, ".config", "monikim", "config.yaml"))
+	}
+	if xdg := os.Getenv("XDG_CONFIG_HOME"); xdg != "" {
+		if path := filepath.Join(xdg, "monikim", "config.yaml"); !contains(paths, path) {
+			paths = append(paths, path)
+		}
+	}
+	return append(paths, "config.yaml")
+}
+
+// discoverConfigPaths returns the config search paths that exist, lowest priority first
+func discoverConfigPaths() []string {
+	var found []string
+	for _, path := range configSearchPaths() {
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			found = append(found, path)
+		}
+	}
+	return found
+}
+
+// mergeConfigs returns base with every setting that override sets replacing the one in base.
+// Settings left empty or unset in override keep the base value. Nested blocks such as geo_block are merged
+// setting by setting and maps such as param_source_mapping key by key, so a later file only changes what it sets.
+func mergeConfigs(base, override *Config) *Config {
+	merged := *base
+	mergeValue(reflect.ValueOf(&merged).Elem(), reflect.ValueOf(override).Elem())
+	return &merged
+}
+
+// mergeValue merges the exported settings of override into merged, recursing into structs and maps
+func mergeValue(merged, override reflect.Value) {
+	switch override.Kind() {
+	case reflect.Struct:
+		for i := 0; i < override.NumField(); i++ {
+			if override.Type().Field(i).IsExported() {
+				mergeValue(merged.Field(i), override.Field(i))
+			}
+		}
+	case reflect.Map:
+		if override.Len() == 0 {
+			return
+		}
+		// Copy into a new map so merging never writes into a map the earlier config still holds
+		combined := reflect.MakeMapWithSize(override.Type(), merged.Len()+override.Len())
+		for _, source := range []reflect.Value{merged, override} {
+			for iter := source.MapRange(); iter.Next(); {
+				combined.SetMapIndex(iter.Key(), iter.Value())
+			}
+		}
+		merged.Set(combined)
+	default:
+		if !override.IsZero() {
+			merged.Set(override)
+		}
+	}
+}
+
+// isRemoteConfig reports whether the config path is an http(s) URL
+func isRemoteConfig(configPath string) bool {
+	return strings.HasPrefix(configPath, "http://") || strings.HasPrefix(configPath, "https://")
+}
+
+// loadConfigWithContext loads configuration from YAML files or http(s) URLs, giving up when ctx is done.
+// The files are merged with mergeConfigs in order, so later files override earlier ones, and the
+// MONIKIM_<SETTING> environment variables override them all.
+func loadConfigWithContext(ctx context.Context, configPaths ...string) (*Config, error) {
+	merged := &Config{}
+	for _, configPath := range configPaths {
+		config, err := decodeConfig(ctx, configPath)
+		if err != nil {
+			var sensitive *SensitiveError
+			if errors.As(err, &sensitive) {
+				server.logger().Error(sensitive.Public(), slog.String("error", sensitive.Internal()))
+			}
+			return nil, err
+		}
+		merged = mergeConfigs(merged, config)
+	}
+	env, err := envConfig()
+	if err != nil {
+		return nil, err
+	}
+	return applyPreset(mergeConfigs(merged, env)).WithDefaults(), nil
+}
+
+// envConfigPrefix starts the environment variables that override a setting: MONIKIM_PORT sets port,
+// MONIKIM_GEO_BLOCK sets geo_block and so on. MONIKIM_CONFIG names the config file instead.
+const envConfigPrefix = "MONIKIM_"
+
+// envConfig decodes the MONIKIM_<SETTING> environment variables into a config. Each value is read as YAML, so
+// MONIKIM_CORS_ENABLED=true sets a bool and MONIKIM_ALLOWED_ORIGINS='["*"]' a list.
+func envConfig() (*Config, error) {
+	config := &Config{}
+	configType := reflect.TypeOf(Config{})
+	for i := 0; i < configType.NumField(); i++ {
+		setting, _, _ := strings.Cut(configType.Field(i).Tag.Get("yaml"), ",")
+		if setting == "" || setting == "-" {
+			continue
+		}
+		name := envConfigPrefix + strings.ToUpper(setting)
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		// Decoding the value on its own and re-encoding it under its key saves re-indenting multi-line values
+		var decoded interface{}
+		if err := yaml.Unmarshal([]byte(value), &decoded); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		data, err := yaml.Marshal(map[string]interface{}{setting: decoded})
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		var layer Config
+		if err := yaml.Unmarshal(data, &layer); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		config = mergeConfigs(config, &layer)
+	}
+	return config, nil
+}
+
+// errConfigUnreadable is the public message of config read errors; the path or URL only goes to the log
+const errConfigUnreadable = "\u65e0\u6cd5\u8bfb\u53d6\u914d\u7f6e\u6587\u4ef6"
+
+// decodeConfig reads one YAML config file or http(s) URL without applying defaults
+func decodeConfig(ctx context.Context, configPath string) (*Config, error) {
+	var body io.ReadCloser
+	if isRemoteConfig(configPath) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, configPath, nil)
+		if err != nil {
+			return nil, newSensitiveError(errConfigUnreadable, err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, newSensitiveError(errConfigUnreadable, err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, newSensitiveError(errConfigUnreadable, fmt.Errorf("GET %s: %s", configPath, resp.Status))
+		}
+		body = resp.Body
+	} else {
+		file, err := openWithContext(ctx, configPath)
+		if err != nil {
+			return nil, newSensitiveError(errConfigUnreadable, err)
+		}
+		body = file
+	}
+	defer body.Close()
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, newSensitiveError(errConfigUnreadable, err)
+	}
+	var config Config
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("\u89e3\u6790\u914d\u7f6e\u6587\u4ef6\u51fa\u9519: %w", newConfigError(data, err))
+	}
+	return &config, nil
+}
+
+// ConfigError locates a YAML decoding error in the config file
+type ConfigError struct {
+	Field  string
+	Line   int
+	Column int
+	Cause  error
+}
+
+// Error implements the error interface
+func (e *ConfigError) Error() string {
+	switch {
+	case e.Line == 0:
+		return e.Cause.Error()
+	case e.Field == "":
+		return fmt.Sprintf("line %d: %v", e.Line, e.Cause)
+	default:
+		return fmt.Sprintf("line %d, column %d: %s: %v", e.Line, e.Column, e.Field, e.Cause)
+	}
+}
+
+// Unwrap returns the underlying yaml error
+func (e *ConfigError) Unwrap() error {
+	return e.Cause
+}
+
+// yamlErrorLine matches the "line N: message" form yaml uses to report decoding errors
+var yamlErrorLine = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+
+// newConfigError converts a yaml decoding error of data into ConfigErrors, one per reported problem.
+// yaml only reports line numbers, so the field and column are taken from the key on that line.
+func newConfigError(data []byte, err error) error {
+	messages := []string{err.Error()}
+	var typeErr *yaml.TypeError
+	if errors.As(err, &typeErr) {
+		messages = typeErr.Errors
+	}
+
+	lines := strings.Split(string(data), "\n")
+	var errs []error
+	for _, message := range messages {
+		match := yamlErrorLine.FindStringSubmatch(message)
+		if match == nil {
+			errs = append(errs, &ConfigError{Cause: errors.New(message)})
+			continue
+		}
+		configErr := &ConfigError{Cause: errors.New(match[2])}
+		configErr.Line, _ = strconv.Atoi(match[1])
+		if configErr.Line <= len(lines) {
+			text := lines[configErr.Line-1]
+			key := strings.TrimLeft(text, " \t-")
+			if i := strings.Index(key, ":"); i > 0 {
+				configErr.Field = strings.Trim(key[:i], `"' `)
+				configErr.Column = len(text) - len(key) + 1
+			}
+		}
+		errs = append(errs, configErr)
+	}
+	if len(errs) == 1 {
+		return errs[0]
+	}
+	return errors.Join(errs...)
+}
+
+// openWithContext opens a file but stops waiting when ctx is done, e.g. on a hung network file system
+func openWithContext(ctx context.Context, path string) (*os.File, error) {
+	type openResult struct {
+		file *os.File
+		err  error
+	}
+	results := make(chan openResult, 1)
+	go func() {
+		file, err := os.Open(path)
+		results <- openResult{file, err}
+	}()
+
+	select {
+	case result := <-results:
+		return result.file, result.err
+	case <-ctx.Done():
+		// Close the file if the open eventually succeeds
+		go func() {
+			if result := <-results; result.file != nil {
+				result.file.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// boolPtr returns a pointer to b, for filling optional config fields
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+// intPtr returns a pointer to n, for filling optional config fields
+func intPtr(n int) *int {
+	return &n
+}
+
+// stringPtr returns a pointer to s, for filling optional config fields
+func stringPtr(s string) *string {
+	return &s
+}
+
+// WithDefaults returns a copy of the config with every unset field filled with its default value.
+// Optional bool and int fields are pointers so that an explicit false or 0 can be told apart from an absent field.
+func (config *Config) WithDefaults() *Config {
+	c := *config
+	if c.Port == "" {
+		c.Port = defaultPort
+	}
+	if c.AllowedExtensions == nil {
+		c.AllowedExtensions = []string{".jpg", ".jpeg", ".png", ".gif", ".webp"}
+	}
+	if c.SessionTTL <= 0 {
+		c.SessionTTL = 30 * time.Minute
+	}
+	if c.SessionGCInterval <= 0 {
+		c.SessionGCInterval = 5 * time.Minute
+	}
+	if c.ThumbnailWidth == nil {
+		c.ThumbnailWidth = intPtr(200)
+	}
+	if c.ThumbnailHeight == nil {
+		c.ThumbnailHeight = intPtr(200)
+	}
+	if c.ThumbnailCleanupInterval <= 0 {
+		c.ThumbnailCleanupInterval = time.Hour
+	}
+	if c.SignedURLTTL <= 0 {
+		c.SignedURLTTL = 5 * time.Minute
+	}
+	if c.ShutdownTimeout <= 0 {
+		c.ShutdownTimeout = 30 * time.Second
+	}
+	if c.SSEInterval <= 0 {
+		c.SSEInterval = 10 * time.Second
+	}
+	if c.WebSocket == nil {
+		c.WebSocket = boolPtr(false)
+	}
+	if c.WSPushInterval <= 0 {
+		c.WSPushInterval = 10 * time.Second
+	}
+	if c.MaxWSConnections == nil {
+		c.MaxWSConnections = intPtr(100)
+	}
+	if c.ErrorFormat == "" {
+		c.ErrorFormat = "text"
+	}
+	if c.HandlerPath == "" {
+		c.HandlerPath = "/"
+	}
+	if c.HTMLTemplate == "" {
+		c.HTMLTemplate = defaultHTMLTemplate
+	}
+	if c.CSSProperty == "" {
+		c.CSSProperty = "background-image"
+	}
+	if c.RobotsTxt == "" {
+		c.RobotsTxt = "User-agent: *\nDisallow: /\n"
+	}
+	if c.DisableFileTypeCheck == nil {
+		c.DisableFileTypeCheck = boolPtr(false)
+	}
+	if c.CaseSensitiveExtensions == nil {
+		c.CaseSensitiveExtensions = boolPtr(false)
+	}
+	if c.CorsEnabled == nil {
+		c.CorsEnabled = boolPtr(false)
+	}
+	if c.AllowCredentials == nil {
+		c.AllowCredentials = boolPtr(false)
+	}
+	if c.RefererCheckEnabled == nil {
+		c.RefererCheckEnabled = boolPtr(false)
+	}
+	if c.VersionEndpointEnabled == nil {
+		c.VersionEndpointEnabled = boolPtr(false)
+	}
+	if c.Placeholder == nil {
+		c.Placeholder = boolPtr(false)
+	}
+	if c.AllowQueryResize == nil {
+		c.AllowQueryResize = boolPtr(false)
+	}
+	if c.ConfigWatchEnabled == nil {
+		c.ConfigWatchEnabled = boolPtr(false)
+	}
+	if c.StrictSourceMode == nil {
+		c.StrictSourceMode = boolPtr(false)
+	}
+	if c.StatsEndpointEnabled == nil {
+		c.StatsEndpointEnabled = boolPtr(false)
+	}
+	if c.SchemaEndpointEnabled == nil {
+		c.SchemaEndpointEnabled = boolPtr(false)
+	}
+	if c.SuppressDisableFileTypeCheckWarning == nil {
+		c.SuppressDisableFileTypeCheckWarning = boolPtr(false)
+	}
+	if c.ListEndpointEnabled == nil {
+		c.ListEndpointEnabled = boolPtr(false)
+	}
+	if c.GeoBlock.Enabled == nil {
+		c.GeoBlock.Enabled = boolPtr(false)
+	}
+	if c.Recommendation.Enabled == nil {
+		c.Recommendation.Enabled = boolPtr(false)
+	}
+	if c.Recommendation.Timeout <= 0 {
+		c.Recommendation.Timeout = 500 * time.Millisecond
+	}
+	if c.BlockBadBots == nil {
+		c.BlockBadBots = boolPtr(false)
+	}
+	if c.XRobotsTag == nil {
+		c.XRobotsTag = stringPtr("noindex, nofollow")
+	}
+	if c.MaxConcurrentRequests == nil {
+		c.MaxConcurrentRequests = intPtr(0)
+	}
+	if c.PlaceholderWidth == nil {
+		c.PlaceholderWidth = intPtr(400)
+	}
+	if c.PlaceholderHeight == nil {
+		c.PlaceholderHeight = intPtr(300)
+	}
+	if c.MaxResizeWidth == nil {
+		c.MaxResizeWidth = intPtr(2048)
+	}
+	if c.MaxResizeHeight == nil {
+		c.MaxResizeHeight = intPtr(2048)
+	}
+	if c.MaxDecodePixels == nil {
+		c.MaxDecodePixels = intPtr(40_000_000)
+	}
+	if c.ContentTypeSniff == nil {
+		c.ContentTypeSniff = boolPtr(false)
+	}
+	if c.AVIFEnabled == nil {
+		c.AVIFEnabled = boolPtr(false)
+	}
+	if c.AVIFQuality == nil {
+		c.AVIFQuality = intPtr(60)
+	}
+	if c.MaxHeaderBytes == nil {
+		c.MaxHeaderBytes = intPtr(http.DefaultMaxHeaderBytes)
+	}
+	if c.DisableKeepAlives == nil {
+		c.DisableKeepAlives = boolPtr(false)
+	}
+	if c.MaxBatchSize == nil {
+		c.MaxBatchSize = intPtr(10)
+	}
+	if c.ContentCacheSize == nil {
+		c.ContentCacheSize = intPtr(128)
+	}
+	return &c
+}
+
+// compile pre-computes the lookup structures derived from the settings; it runs once per loaded config
+func (config *Config) compile() error {
+	htmlTemplate, err := htmltemplate.New("html").Parse(config.HTMLTemplate)
+	if err != nil {
+		return &ValidationError{Field: "html_template", Code: errInvalidValue, Message: err.Error()}
+	}
+	config.htmlTemplate = htmlTemplate
+	config.allowedExtSet = newExtSet(config.AllowedExtensions, *config.CaseSensitiveExtensions)
+	// Sources sharing a directory share the union of their extension lists
+	dirExtensions := make(map[string][]string)
+	for source, extensions := range config.SourceExtensions {
+		dir := config.ParamSourceMapping[source]
+		dirExtensions[dir] = append(dirExtensions[dir], extensions...)
+	}
+	config.dirExtSets = make(map[string]map[string]struct{}, len(dirExtensions))
+	for dir, extensions := range dirExtensions {
+		config.dirExtSets[dir] = newExtSet(extensions, *config.CaseSensitiveExtensions)
+	}
+
+	config.userAgentPatterns = nil
+	for _, expr := range config.BlockedUserAgentPatterns {
+		pattern, err := regexp.Compile(expr)
+		if err != nil {
+			return &ValidationError{Field: "blocked_user_agent_patterns", Code: errInvalidPattern, Message: fmt.Sprintf("invalid pattern %q: %v", expr, err)}
+		}
+		config.userAgentPatterns = append(config.userAgentPatterns, pattern)
+	}
+	if *config.BlockBadBots {
+		config.userAgentPatterns = append(config.userAgentPatterns, badBotPattern)
+	}
+	config.manifests = new(sync.Map)
+	config.sniffedTypes = new(sync.Map)
+	config.sourcePatterns = nil
+	for source := range config.ParamSourceMapping {
+		if !isGlobPattern(source) {
+			continue
+		}
+		if _, err := filepath.Match(source, ""); err != nil {
+			return &ValidationError{Field: "param_source_mapping." + source, Code: errInvalidPattern, Message: fmt.Sprintf("invalid pattern %q: %v", source, err)}
+		}
+		config.sourcePatterns = append(config.sourcePatterns, source)
+	}
+	sort.Strings(config.sourcePatterns)
+	return nil
+}
+
+// extSetFor returns the extension set for an image directory: its source_extensions if any, allowed_extensions otherwise
+func (config *Config) extSetFor(imageDir string) map[string]struct{} {
+	if extSet, exists := config.dirExtSets[imageDir]; exists {
+		return extSet
+	}
+	return config.allowedExtSet
+}
+
+// isGlobPattern reports whether a directory setting contains glob meta characters
+func isGlobPattern(dir string) bool {
+	return strings.ContainsAny(dir, "*?[")
+}
+
+// expandImageDirs expands the glob patterns used as image directories; it runs at startup and after every reload
+func (config *Config) expandImageDirs() {
+	patterns := []string{config.ImageDir}
+	for _, dir := range config.ParamSourceMapping {
+		patterns = append(patterns, dir)
+	}
+
+	config.imageDirs = make(map[string][]string)
+	for _, pattern := range patterns {
+		if !isGlobPattern(pattern) {
+			continue
+		}
+		matches, _ := filepath.Glob(pattern)
+		var dirs []string
+		for _, match := range matches {
+			if info, err := os.Stat(match); err == nil && info.IsDir() {
+				dirs = append(dirs, match)
+			}
+		}
+		config.imageDirs[pattern] = dirs
+	}
+}
+
+// dirsFor returns the directories to scan for an image_dir or param_source_mapping value
+func (config *Config) dirsFor(imageDir string) []string {
+	if dirs, exists := config.imageDirs[imageDir]; exists {
+		return dirs
+	}
+	return []string{imageDir}
+}
+
+// Validation error codes
+const (
+	errInvalidPattern  = "INVALID_PATTERN"
+	errPathNotFound    = "PATH_NOT_FOUND"
+	errInvalidValue    = "INVALID_VALUE"
+	errMissingRequired = "MISSING_REQUIRED"
+	errInvalidPort     = "INVALID_PORT"
+)
+
+// ValidationError describes a config setting that failed validation
+type ValidationError struct {
+	Field   string
+	Code    string
+	Message string
+}
+
+// Error implements the error interface
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%s: %s (%s)", e.Field, e.Message, e.Code)
+}
+
+// knownModes lists the accepted values of the mode setting
+var knownModes = map[string]bool{
+	"":                true,
+	"direct":          true,
+	"redir":           true,
+	"redirect_signed": true,
+	"shuffle":         true,
+	"sequential":      true,
+	"sse":             true,
+	"html":            true,
+	"css":             true,
+	"xml":             true,
+	"thumbnail":       true,
+}
+
+// checkImageDir verifies that an image directory exists; glob patterns are checked when they are expanded instead
+func checkImageDir(field, dir string) error {
+	if _, err := filepath.Glob(dir); err != nil {
+		return &ValidationError{Field: field, Code: errInvalidPattern, Message: fmt.Sprintf("invalid pattern %q: %v", dir, err)}
+	}
+	if isGlobPattern(dir) {
+		return nil
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		return &ValidationError{Field: field, Code: errPathNotFound, Message: fmt.Sprintf("directory %q does not exist", dir)}
+	}
+	if !info.IsDir() {
+		return &ValidationError{Field: field, Code: errPathNotFound, Message: fmt.Sprintf("%q is not a directory", dir)}
+	}
+	return nil
+}
+
+// checkSourceDirs checks every param_source_mapping directory and logs a warning for each missing one.
+// Missing directories only abort startup in strict_source_mode; invalid patterns always do.
+func checkSourceDirs(config *Config) error {
+	sources := make([]string, 0, len(config.ParamSourceMapping))
+	for source := range config.ParamSourceMapping {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+
+	var missing []error
+	for _, source := range sources {
+		err := checkImageDir("param_source_mapping."+source, config.ParamSourceMapping[source])
+		if err == nil {
+			continue
+		}
+		if verr, ok := err.(*ValidationError); !ok || verr.Code != errPathNotFound {
+			return err
+		}
+		server.logger().Warn("\u56fe\u7247\u76ee\u5f55\u4e0d\u5b58\u5728", slog.String("source", source), slog.Any("error", err))
+		missing = append(missing, err)
+	}
+	if len(missing) > 0 && *config.StrictSourceMode {
+		return errors.Join(missing...)
+	}
+	return nil
+}
+
+// reservedPaths are the fixed endpoints that handler_path may not take over
+var reservedPaths = map[string]bool{
+	"/health": true, "/ready": true, "/robots.txt": true, "/favicon.ico": true, "/verify": true, "/version": true,
+	"/stats": true, "/list": true, "/admin/shutdown": true, "/schema": true, "/openapi.yaml": true, "/ws": true,
+}
+
+// defaultPort is used when the config leaves port empty
+const defaultPort = "8080"
+
+// checkPort validates a listen port: a number from 1 to 65535, "0" for an OS assigned port, or a known service name
+func checkPort(field, port string) error {
+	if n, err := strconv.Atoi(port); err == nil {
+		if n < 0 || n > 65535 {
+			return &ValidationError{Field: field, Code: errInvalidPort, Message: fmt.Sprintf("port %d must be between 1 and 65535, or 0 for any free port", n)}
+		}
+		return nil
+	}
+	if _, err := net.LookupPort("tcp", port); err != nil {
+		return &ValidationError{Field: field, Code: errInvalidPort, Message: fmt.Sprintf("%q is neither a port number nor a known service name", port)}
+	}
+	return nil
+}
+
+// validateConfig checks the loaded configuration for settings that cannot work, reporting the first problem
+func validateConfig(config *Config) error {
+	if errs := validateFields(config); len(errs) > 0 {
+		return errs[0]
+	}
+	if err := checkImageDir("image_dir", config.ImageDir); err != nil {
+		return err
+	}
+	if err := checkSourceDirs(config); err != nil {
+		return err
+	}
+	// The list files are merged by now, so a list file without entries is caught here
+	if *config.CorsEnabled && len(config.AllowedOrigins) == 0 {
+		return &ValidationError{Field: "allowed_origins", Code: errMissingRequired, Message: "cors_enabled requires at least one allowed_origins entry or explicit '*'"}
+	}
+	if *config.CorsEnabled && *config.AllowCredentials && contains(config.AllowedOrigins, "*") {
+		return &ValidationError{Field: "allow_credentials", Code: errInvalidValue, Message: "allow_credentials requires explicit allowed_origins, not '*'"}
+	}
+	if *config.RefererCheckEnabled && len(config.AllowedReferers) == 0 {
+		return &ValidationError{Field: "allowed_referers", Code: errMissingRequired, Message: "referer_check_enabled requires at least one allowed_referers entry"}
+	}
+	return nil
+}
+
+// validateFields checks the settings that can be judged without the file system and returns every violation.
+// It only reads config. Directories, and the origin and referer rules that depend on the merged list files, are
+// left to validateConfig.
+func validateFields(config *Config) []error {
+	var errs []error
+	if err := checkPort("port", config.Port); err != nil {
+		errs = append(errs, err)
+	}
+	if config.GRPCPort != "" {
+		if err := checkPort("grpc_port", config.GRPCPort); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if !strings.HasPrefix(config.HandlerPath, "/") {
+		errs = append(errs, &ValidationError{Field: "handler_path", Code: errInvalidValue, Message: fmt.Sprintf("%q must start with /", config.HandlerPath)})
+	}
+	if reservedPaths[config.HandlerPath] {
+		errs = append(errs, &ValidationError{Field: "handler_path", Code: errInvalidValue, Message: fmt.Sprintf("%q is already served by monikim", config.HandlerPath)})
+	}
+	if config.ImageDir == "" {
+		errs = append(errs, &ValidationError{Field: "image_dir", Code: errMissingRequired, Message: "image_dir is required"})
+	}
+	if !*config.DisableFileTypeCheck && len(config.AllowedExtensions) == 0 {
+		errs = append(errs, &ValidationError{Field: "allowed_extensions", Code: errMissingRequired, Message: "at least one extension is required unless disable_file_type_check is true"})
+	}
+	for source := range config.SourceExtensions {
+		if _, exists := config.ParamSourceMapping[source]; !exists {
+			errs = append(errs, &ValidationError{Field: "source_extensions." + source, Code: errInvalidValue, Message: fmt.Sprintf("%q is not a param_source_mapping source", source)})
+		}
+	}
+	if !knownErrorFormats[config.ErrorFormat] {
+		errs = append(errs, &ValidationError{Field: "error_format", Code: errInvalidValue, Message: fmt.Sprintf("unknown error format %q, expected text, json or html", config.ErrorFormat)})
+	}
+	if _, known := configPresets[config.Preset]; config.Preset != "" && !known {
+		errs = append(errs, &ValidationError{Field: "preset", Code: errInvalidValue, Message: fmt.Sprintf("unknown preset %q, expected cdn, development or strict", config.Preset)})
+	}
+	if !knownModes[config.Mode] {
+		errs = append(errs, &ValidationError{Field: "mode", Code: errInvalidValue, Message: fmt.Sprintf("unknown mode %q", config.Mode)})
+	}
+	if *config.GeoBlock.Enabled && config.GeoBlock.DBPath == "" {
+		errs = append(errs, &ValidationError{Field: "geo_block.db_path", Code: errMissingRequired, Message: "geo_block.enabled requires db_path"})
+	}
+	if *config.MaxDecodePixels < 1 {
+		errs = append(errs, &ValidationError{Field: "max_decode_pixels", Code: errInvalidValue, Message: fmt.Sprintf("max_decode_pixels %d must be positive", *config.MaxDecodePixels)})
+	}
+	if *config.ContentCacheSize < 0 {
+		errs = append(errs, &ValidationError{Field: "content_cache_size", Code: errInvalidValue, Message: fmt.Sprintf("content_cache_size %d must not be negative", *config.ContentCacheSize)})
+	}
+	if *config.ThumbnailWidth < 1 || *config.ThumbnailHeight < 1 {
+		errs = append(errs, &ValidationError{Field: "thumbnail_width", Code: errInvalidValue, Message: fmt.Sprintf("thumbnail size %dx%d must be positive", *config.ThumbnailWidth, *config.ThumbnailHeight)})
+	}
+	if *config.MaxHeaderBytes < 1 {
+		errs = append(errs, &ValidationError{Field: "max_header_bytes", Code: errInvalidValue, Message: fmt.Sprintf("%d must be at least 1", *config.MaxHeaderBytes)})
+	}
+	if *config.MaxWSConnections < 1 {
+		errs = append(errs, &ValidationError{Field: "max_ws_connections", Code: errInvalidValue, Message: fmt.Sprintf("%d must be at least 1", *config.MaxWSConnections)})
+	}
+	if *config.AVIFQuality < 1 || *config.AVIFQuality > 100 {
+		errs = append(errs, &ValidationError{Field: "avif_quality", Code: errInvalidValue, Message: fmt.Sprintf("%d is not between 1 and 100", *config.AVIFQuality)})
+	}
+	if *config.Recommendation.Enabled {
+		if u, err := url.Parse(config.Recommendation.Endpoint); config.Recommendation.Endpoint == "" {
+			errs = append(errs, &ValidationError{Field: "recommendation.endpoint", Code: errMissingRequired, Message: "recommendation.enabled requires endpoint"})
+		} else if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			errs = append(errs, &ValidationError{Field: "recommendation.endpoint", Code: errInvalidValue, Message: fmt.Sprintf("%q is not an http or https URL", config.Recommendation.Endpoint)})
+		}
+	}
+	if config.Mode == "thumbnail" && config.ThumbnailCacheDir == "" {
+		errs = append(errs, &ValidationError{Field: "thumbnail_cache_dir", Code: errMissingRequired, Message: "mode thumbnail requires thumbnail_cache_dir"})
+	}
+	if config.Mode == "redirect_signed" && config.SigningSecret == "" {
+		errs = append(errs, &ValidationError{Field: "signing_secret", Code: errMissingRequired, Message: "mode redirect_signed requires signing_secret"})
+	}
+	return errs
+}
+
+// handleCORS sets the appropriate CORS headers based on the config
+func handleCORS(w http.ResponseWriter, r *http.Request, config *Config) {
+	// Same-origin requests carry no Origin header and need no CORS headers
+	if r.Header.Get("Origin") == "" {
+		return
+	}
+	if *config.CorsEnabled {
+		origin := r.Header.Get("Origin")
+		if *config.AllowCredentials {
+			// Browsers reject credentialed responses for "*", so only a listed origin is echoed back
+			if contains(config.AllowedOrigins, origin) {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+				w.Header().Add("Vary", "Origin")
+			}
+		} else {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+			for _, allowedOrigin := range config.AllowedOrigins {
+				if allowedOrigin == "*" || allowedOrigin == origin {
+					w.Header().Set("Access-Control-Allow-Origin", allowedOrigin)
+					break
+				}
+			}
+		}
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST")
+		if len(config.AllowedMethods) > 0 {
+			w.Header().Set("Access-Control-Allow-Methods", strings.Join(config.AllowedMethods, ", "))
+		}
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		if len(config.AllowedHeaders) > 0 {
+			w.Header().Set("Access-Control-Allow-Headers", strings.Join(config.AllowedHeaders, ", "))
+		}
+		if len(config.ExposedHeaders) > 0 {
+			w.Header().Set("Access-Control-Expose-Headers", strings.Join(config.ExposedHeaders, ", "))
+		}
+	}
+}
+
+// withServerHeader sets the Server response header from the current config. net/http sends no Server header of
+// its own, so responses carry none while server_header is empty.
+func withServerHeader(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if header := currentConfig.Load().ServerHeader; header != "" {
+			w.Header().Set("Server", header)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// concurrencySlotKey is the request context key of the function that frees the request's concurrency slot
+type concurrencySlotKey struct{}
+
+// withConcurrencyLimit rejects requests with 503 once limit requests are already in flight; 0 means unlimited.
+// A handler can give its slot back early with releaseConcurrencySlot.
+func withConcurrencyLimit(next http.Handler, limit int) http.Handler {
+	if limit <= 0 {
+		return next
+	}
+	slots := make(chan struct{}, limit)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case slots <- struct{}{}:
+			var once sync.Once
+			release := func() { once.Do(func() { <-slots }) }
+			defer release()
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), concurrencySlotKey{}, release)))
+		default:
+			w.Header().Set("Retry-After", "1")
+			writeError(w, http.StatusServiceUnavailable, "503 Service Unavailable", "TOO_MANY_REQUESTS")
+		}
+	})
+}
+
+// releaseConcurrencySlot frees the max_concurrent_requests slot held by r, for handlers that keep their connection
+// open long after the request itself is handled
+func releaseConcurrencySlot(r *http.Request) {
+	if release, ok := r.Context().Value(concurrencySlotKey{}).(func()); ok {
+		release()
+	}
+}
+
+// newExtSet builds an extension lookup set, lower-casing the extensions unless caseSensitive is set
+func newExtSet(extensions []string, caseSensitive bool) map[string]struct{} {
+	set := make(map[string]struct{}, len(extensions))
+	for _, ext := range extensions {
+		if !caseSensitive {
+			ext = strings.ToLower(ext)
+		}
+		set[ext] = struct{}{}
+	}
+	return set
+}
+
+// isValidExtension checks if the file extension is in the set built by newExtSet with the same caseSensitive setting
+func isValidExtension(fileName string, allowedExtSet map[string]struct{}, caseSensitive bool) bool {
+	ext := filepath.Ext(fileName)
+	if !caseSensitive {
+		ext = strings.ToLower(ext)
+	}
+	_, exists := allowedExtSet[ext]
+	return exists
+}
+
+// serveImageRedirect redirects to the image URL instead of serving it directly
+func serveImageRedirect(w http.ResponseWriter, r *http.Request, target string) {
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// redirectETag identifies the redirect target by its path and modification time
+func redirectETag(selected imageFile) string {
+	sum := sha256.Sum256([]byte(selected.Path() + selected.ModTime.UTC().Format(time.RFC3339Nano)))
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// serveImageFile serves the specified image file. contentType is the content type recorded when the file was
+// scanned; when it is empty it is looked up from the extension, and http.ServeFile sniffs files without one.
+func serveImageFile(w http.ResponseWriter, r *http.Request, imagePath, contentType string) {
+	if r.Context().Err() != nil {
+		return
+	}
+	if contentType == "" {
+		contentType = mime.TypeByExtension(filepath.Ext(imagePath))
+	}
+	if contentType != "" && isPlainGet(r) {
+		if serveFileFast(w, imagePath, contentType) {
+			return
+		}
+	}
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	// http.ServeFile answers If-None-Match and If-Range from the ETag set here
+	if info, err := os.Stat(imagePath); err == nil {
+		w.Header().Set("ETag", fileETag(info))
+	}
+	http.ServeFile(contextWriter{ResponseWriter: w, ctx: r.Context()}, r, imagePath)
+}
+
+// fileETag identifies a version of a file by its modification time and size
+func fileETag(info os.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size())
+}
+
+// isPlainGet reports whether r is a GET without range or conditional headers, which needs none of http.ServeFile's logic
+func isPlainGet(r *http.Request) bool {
+	if r.Method != http.MethodGet {
+		return false
+	}
+	for _, header := range []string{"Range", "If-Range", "If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since"} {
+		if r.Header.Get(header) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// serveFileFast copies the file straight to w, which lets the connection use sendfile(2) on Linux.
+// It reports false without writing anything if the file cannot be served this way.
+func serveFileFast(w http.ResponseWriter, imagePath, contentType string) bool {
+	file, err := os.Open(imagePath)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		return false
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+	w.Header().Set("Last-Modified", info.ModTime().UTC().Format(http.TimeFormat))
+	w.Header().Set("ETag", fileETag(info))
+	w.Header().Set("Accept-Ranges", "bytes")
+	io.Copy(w, file)
+	return true
+}
+
+// contextWriter fails writes once ctx is done, so the copy loop in http.ServeFile stops for a client that has gone away
+type contextWriter struct {
+	http.ResponseWriter
+	ctx context.Context
+}
+
+// Write passes b on unless the context is done
+func (cw contextWriter) Write(b []byte) (int, error) {
+	if err := cw.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+// Unwrap exposes the underlying ResponseWriter to http.ResponseController
+func (cw contextWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// setContentDisposition names the served file so browsers can show and save it under its real name.
+// Non-ASCII names are sent percent-encoded in filename* as described in RFC 5987.
+func setContentDisposition(w http.ResponseWriter, imagePath string) {
+	name := filepath.Base(imagePath)
+	fallback := strings.Map(func(c rune) rune {
+		if c < 0x20 || c > 0x7e || c == '"' || c == '\\' {
+			return '_'
+		}
+		return c
+	}, name)
+	value := fmt.Sprintf("inline; filename=\"%s\"", fallback)
+	if fallback != name {
+		value += "; filename*=UTF-8''" + encodeRFC5987(name)
+	}
+	w.Header().Set("Content-Disposition", value)
+}
+
+// transcodedExtensions maps the content types images are re-encoded to onto the extension their file is named with
+var transcodedExtensions = map[string]string{"image/jpeg": ".jpg", "image/png": ".png", "image/avif": ".avif"}
+
+// setTranscodedDisposition names a re-encoded image after its source file, with the extension changed to match the
+// content type it is served as unless the source extension already does
+func setTranscodedDisposition(w http.ResponseWriter, imagePath, contentType string) {
+	ext := filepath.Ext(imagePath)
+	if newExt, ok := transcodedExtensions[contentType]; ok && mime.TypeByExtension(ext) != contentType {
+		imagePath = strings.TrimSuffix(imagePath, ext) + newExt
+	}
+	setContentDisposition(w, imagePath)
+}
+
+// encodeRFC5987 percent-encodes every byte that is not an attr-char of RFC 5987
+func encodeRFC5987(value string) string {
+	var sb strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("!#$&+-.^_`|~", c) >= 0 {
+			sb.WriteByte(c)
+		} else {
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+	return sb.String()
+}
+
+// signImage computes the HMAC-SHA256 signature of a signed URL for the named image of a source. The fields are
+// quoted so that no two different (source, name, expires) triples produce the same message.
+func signImage(secret, source, name string, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%q\n%q\n%d", source, name, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// serveSignedRedirect redirects to a /verify URL that is only valid until the configured TTL expires. The URL names
+// the image by its source and file name, so the path of the image directory is never disclosed.
+func serveSignedRedirect(w http.ResponseWriter, r *http.Request, config *Config, name string) {
+	source := r.URL.Query().Get("source")
+	expires := time.Now().Add(config.SignedURLTTL).Unix()
+	query := url.Values{}
+	if source != "" {
+		query.Set("source", source)
+	}
+	query.Set("file", name)
+	query.Set("expires", strconv.FormatInt(expires, 10))
+	query.Set("sig", signImage(config.SigningSecret, source, name, expires))
+	http.Redirect(w, r, "/verify?"+query.Encode(), http.StatusFound)
+}
+
+// handleVerify serves the image of a signed URL if the signature is valid and has not expired. Only images found by
+// scanning the source are served, and every URL is refused while no signing_secret is configured, which a reload
+// away from redirect_signed mode allows.
+func handleVerify(w http.ResponseWriter, r *http.Request, config *Config) {
+	if config.SigningSecret == "" {
+		writeError(w, http.StatusForbidden, "403 Forbidden", "SIGNING_DISABLED")
+		return
+	}
+	query := r.URL.Query()
+	source, name := query.Get("source"), query.Get("file")
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if name == "" || err != nil {
+		writeError(w, http.StatusBadRequest, "400 Bad Request", "INVALID_SIGNED_URL")
+		return
+	}
+	expected := signImage(config.SigningSecret, source, name, expires)
+	if !hmac.Equal([]byte(expected), []byte(query.Get("sig"))) {
+		writeError(w, http.StatusForbidden, "403 Forbidden", "INVALID_SIGNATURE")
+		return
+	}
+	if time.Now().Unix() > expires {
+		writeError(w, http.StatusGone, "410 Gone", "SIGNED_URL_EXPIRED")
+		return
+	}
+	imageDir := resolveImageDir(r, config)
+	if imageDir == "" {
+		writeUnknownSource(w, r)
+		return
+	}
+	validFiles, err := server.scan(config, imageDir)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "\u65e0\u6cd5\u8bfb\u53d6\u56fe\u7247\u76ee\u5f55", "READ_DIR_FAILED")
+		return
+	}
+	for _, file := range validFiles {
+		if file.Entry.Name() == name {
+			setRobotsTag(w, config)
+			setContentDisposition(w, file.Path())
+			serveImageFile(w, r, file.Path(), file.MimeType)
+			return
+		}
+	}
+	writeError(w, http.StatusNotFound, "404 Not Found", "IMAGE_NOT_FOUND")
+}
+
+// setRobotsTag sets the X-Robots-Tag header from x_robots_tag, keeping crawlers from indexing served images
+func setRobotsTag(w http.ResponseWriter, config *Config) {
+	if *config.XRobotsTag != "" {
+		w.Header().Set("X-Robots-Tag", *config.XRobotsTag)
+	}
+}
+
+// imageMethods returns the HTTP methods the image endpoint answers: GET, HEAD, POST and OPTIONS plus any allowed_methods
+func imageMethods(config *Config) []string {
+	methods := []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodOptions}
+	for _, method := range config.AllowedMethods {
+		if method = strings.ToUpper(strings.TrimSpace(method)); !contains(methods, method) {
+			methods = append(methods, method)
+		}
+	}
+	return methods
+}
+
+// contains checks if a slice contains a given element
+func contains(slice []string, item string) bool {
+	for _, element := range slice {
+		if element == item {
+			return true
+		}
+	}
+	return false
+}
+
+// imageFile is a candidate image found while scanning an image directory
+type imageFile struct {
+	Dir     string
+	Entry   os.DirEntry
+	ModTime time.Time
+	Size    int64
+	// MimeType is the content type looked up from the extension when the file was scanned, or sniffed for
+	// extension-less files accepted by content_type_sniff; empty when neither knows the type
+	MimeType string
+}
+
+// Path returns the path of the image file
+func (f imageFile) Path() string {
+	return filepath.Join(f.Dir, f.Entry.Name())
+}
+
+// scanImageFiles lists the valid image files of an image directory, merging every directory matched by a glob pattern
+func scanImageFiles(config *Config, imageDir string) ([]imageFile, error) {
+	var validFiles []imageFile
+	extSet := config.extSetFor(imageDir)
+	files := dirEntryPool.Get().(*[]os.DirEntry)
+	defer func() {
+		*files = (*files)[:0]
+		dirEntryPool.Put(files)
+	}()
+	for _, dir := range config.dirsFor(imageDir) {
+		*files = (*files)[:0]
+		if err := readImageDir(config, dir, files); err != nil {
+			return nil, err
+		}
+		for _, file := range *files {
+			if file.IsDir() {
+				continue
+			}
+			info, err := file.Info()
+			if err != nil {
+				continue
+			}
+			candidate := imageFile{Dir: dir, Entry: file, ModTime: info.ModTime(), Size: info.Size(), MimeType: mime.TypeByExtension(filepath.Ext(file.Name()))}
+			switch {
+			case *config.DisableFileTypeCheck || isValidExtension(file.Name(), extSet, *config.CaseSensitiveExtensions):
+			case *config.ContentTypeSniff && filepath.Ext(file.Name()) == "":
+				candidate.MimeType = sniffContentType(config, candidate)
+				if !strings.HasPrefix(candidate.MimeType, "image/") {
+					continue
+				}
+			default:
+				continue
+			}
+			validFiles = append(validFiles, candidate)
+		}
+	}
+	return validFiles, nil
+}
+
+// sniffedType is a cached content type, valid while the file keeps its modification time
+type sniffedType struct {
+	modTime  time.Time
+	mimeType string
+}
+
+// sniffContentType detects the content type of a file from its first 512 bytes, caching the result per config
+func sniffContentType(config *Config, file imageFile) string {
+	if cached, ok := config.sniffedTypes.Load(file.Path()); ok && cached.(sniffedType).modTime.Equal(file.ModTime) {
+		return cached.(sniffedType).mimeType
+	}
+	f, err := os.Open(file.Path())
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(f, head)
+	mimeType := http.DetectContentType(head[:n])
+	config.sniffedTypes.Store(file.Path(), sniffedType{modTime: file.ModTime, mimeType: mimeType})
+	return mimeType
+}
+
+// dirEntryPool recycles the directory listings built while scanning, which are discarded once the scan is done
+var dirEntryPool = sync.Pool{
+	New: func() any {
+		entries := make([]os.DirEntry, 0, 64)
+		return &entries
+	},
+}
+
+// readImageDir appends the listing of dir to entries, from its manifest_file when there is one and from the
+// directory itself otherwise
+func readImageDir(config *Config, dir string, entries *[]os.DirEntry) error {
+	if config.ManifestFile == "" {
+		return readDirInto(dir, entries)
+	}
+	if cached, ok := config.manifests.Load(dir); ok {
+		if cached == nil {
+			return readDirInto(dir, entries)
+		}
+		*entries = append(*entries, cached.([]os.DirEntry)...)
+		return nil
+	}
+
+	manifest, err := readManifest(dir, config.ManifestFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		config.manifests.Store(dir, nil)
+		return readDirInto(dir, entries)
+	}
+	if err != nil {
+		return err
+	}
+	config.manifests.Store(dir, manifest)
+	*entries = append(*entries, manifest...)
+	return nil
+}
+
+// readDirInto appends the entries of dir to entries sorted by file name, like os.ReadDir
+func readDirInto(dir string, entries *[]os.DirEntry) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	start := len(*entries)
+	for {
+		batch, err := f.ReadDir(64)
+		*entries = append(*entries, batch...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	listed := (*entries)[start:]
+	slices.SortFunc(listed, func(a, b os.DirEntry) int { return strings.Compare(a.Name(), b.Name()) })
+	return nil
+}
+
+// readManifest lists the files named in dir's manifest file that still exist
+func readManifest(dir, manifestFile string) ([]os.DirEntry, error) {
+	names, err := readListFile(filepath.Join(dir, manifestFile))
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]os.DirEntry, 0, len(names))
+	for _, name := range names {
+		// Manifest entries are plain file names in dir; listed files that are gone are skipped
+		if filepath.Base(name) != name {
+			continue
+		}
+		info, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			continue
+		}
+		entries = append(entries, fs.FileInfoToDirEntry(info))
+	}
+	return entries, nil
+}
+
+// filterByExtension returns the files with the given extension
+func filterByExtension(validFiles []imageFile, ext string, caseSensitive bool) []imageFile {
+	extSet := newExtSet([]string{ext}, caseSensitive)
+	filtered := make([]imageFile, 0, len(validFiles))
+	for _, file := range validFiles {
+		if isValidExtension(file.Entry.Name(), extSet, caseSensitive) {
+			filtered = append(filtered, file)
+		}
+	}
+	return filtered
+}
+
+// scan lists the valid image files of an image directory; concurrent callers for the same directory share one scan.
+// The returned slice is shared and must not be modified.
+func (s *Server) scan(config *Config, imageDir string) ([]imageFile, error) {
+	result, err, _ := s.scanGroup.Do(imageDir, func() (interface{}, error) {
+		return scanImageFiles(config, imageDir)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.([]imageFile), nil
+}
+
+// nextSequential returns the next file of the directory in name order, and the file that will follow it
+func (s *Server) nextSequential(imageDir string, validFiles []imageFile) (selected, next imageFile) {
+	value, _ := s.sequences.LoadOrStore(imageDir, new(atomic.Uint64))
+	n := value.(*atomic.Uint64).Add(1) - 1
+	i := int(n % uint64(len(validFiles)))
+	return validFiles[i], validFiles[(i+1)%len(validFiles)]
+}
+
+// sessionCookieName is the cookie that identifies a client in shuffle mode
+const sessionCookieName = "monikim_session"
+
+// shuffleSession holds the per-client play order for one image directory in shuffle mode
+type shuffleSession struct {
+	mu        sync.Mutex
+	Order     []imageFile
+	Pos       int
+	ExpiresAt time.Time
+}
+
+// shuffleSessions maps "<session id>|<image dir>" to *shuffleSession
+var shuffleSessions sync.Map
+
+// newSessionID generates a random session identifier
+func newSessionID() string {
+	b := make([]byte, 16)
+	if _, err := crand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// nextShuffled returns the next file of the client's shuffled order, reshuffling once every file has been served
+func nextShuffled(w http.ResponseWriter, r *http.Request, config *Config, imageDir string, validFiles []imageFile) imageFile {
+	sessionID := ""
+	if cookie, err := r.Cookie(sessionCookieName); err == nil && cookie.Value != "" {
+		sessionID = cookie.Value
+	} else {
+		sessionID = newSessionID()
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    sessionID,
+		Path:     "/",
+		MaxAge:   int(config.SessionTTL / time.Second),
+		HttpOnly: true,
+	})
+
+	value, _ := shuffleSessions.LoadOrStore(sessionID+"|"+imageDir, &shuffleSession{})
+	session := value.(*shuffleSession)
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	if session.Pos >= len(session.Order) || len(session.Order) != len(validFiles) {
+		session.Order = append([]imageFile(nil), validFiles...)
+		rand.Shuffle(len(session.Order), func(i, j int) {
+			session.Order[i], session.Order[j] = session.Order[j], session.Order[i]
+		})
+		session.Pos = 0
+	}
+	selected := session.Order[session.Pos]
+	session.Pos++
+	session.ExpiresAt = time.Now().Add(config.SessionTTL)
+	return selected
+}
+
+// reapSessions periodically removes expired shuffle sessions
+func reapSessions(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		now := time.Now()
+		reaped := 0
+		shuffleSessions.Range(func(key, value interface{}) bool {
+			session := value.(*shuffleSession)
+			session.mu.Lock()
+			expired := !session.ExpiresAt.IsZero() && session.ExpiresAt.Before(now)
+			session.mu.Unlock()
+			if expired {
+				shuffleSessions.Delete(key)
+				reaped++
+			}
+			return true
+		})
+		server.logger().Debug("\u5df2\u6e05\u7406\u8fc7\u671f\u4f1a\u8bdd", slog.Int("reaped", reaped))
+	}
+}
+
+//go:embed templates/placeholder.svg
+var placeholderSVG string
+
+// openAPISpec is the OpenAPI description of the HTTP endpoints, served at /openapi.yaml and printed by --gen-openapi
+//
+//go:embed openapi.yaml
+var openAPISpec string
+
+// exampleConfig is the documented sample config, written as config.example.yaml by --init
+//
+//go:embed config.yaml
+var exampleConfig string
+
+// configTemplate lists every setting with its default value, printed by --config-template
+//
+//go:embed templates/config.template.yaml
+var configTemplate string
+
+// placeholderTemplate renders the SVG served when a directory has no images
+var placeholderTemplate = template.Must(template.New("placeholder").Parse(placeholderSVG))
+
+// servePlaceholder serves a generated grey "No Image Available" SVG
+func servePlaceholder(w http.ResponseWriter, config *Config) {
+	var buf bytes.Buffer
+	if err := placeholderTemplate.Execute(&buf, map[string]int{
+		"Width":  *config.PlaceholderWidth,
+		"Height": *config.PlaceholderHeight,
+	}); err != nil {
+		writeError(w, http.StatusInternalServerError, "\u751f\u6210\u5360\u4f4d\u56fe\u5931\u8d25", "PLACEHOLDER_FAILED")
+		return
+	}
+	w.Header().Set("Content-Type", "image/svg+xml")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(buf.Bytes())
+}
+
+// normalizeReferer reduces a referer URL to scheme, host and path, dropping the query string and fragment.
+// Scheme and host are case-insensitive and compared in lowercase; the path stays case-sensitive (RFC 3986)
+func normalizeReferer(referer string) string {
+	u, err := url.Parse(referer)
+	if err != nil {
+		return referer
+	}
+	return (&url.URL{Scheme: strings.ToLower(u.Scheme), Host: strings.ToLower(u.Host), Path: u.Path}).String()
+}
+
+// isAllowedReferer checks the normalised referer against the normalised allowed referers
+func isAllowedReferer(referer string, allowedReferers []string) bool {
+	referer = normalizeReferer(referer)
+	for _, allowed := range allowedReferers {
+		if normalizeReferer(allowed) == referer {
+			return true
+		}
+	}
+	return false
+}
+
+// imageURL builds the public URL of an image file from BaseURL, or a server relative URL when BaseURL is not set
+func imageURL(config *Config, imagePath string) string {
+	if config.BaseURL == "" {
+		return path.Join("/", filepath.ToSlash(imagePath))
+	}
+	// url.JoinPath collapses the slashes between base_url and the file name, so "https://cdn.example.com/" never yields "//"
+	joined, err := url.JoinPath(config.BaseURL, filepath.Base(imagePath))
+	if err != nil {
+		return strings.TrimSuffix(config.BaseURL, "/") + "/" + filepath.Base(imagePath)
+	}
+	return joined
+}
+
+// serveImageHTML responds with an HTML snippet rendered from html_template
+func serveImageHTML(w http.ResponseWriter, config *Config, imagePath string) {
+	var buf bytes.Buffer
+	if err := config.htmlTemplate.Execute(&buf, map[string]string{
+		"URL":      imageURL(config, imagePath),
+		"Filename": filepath.Base(imagePath),
+	}); err != nil {
+		writeError(w, http.StatusInternalServerError, "\u6e32\u67d3\u6a21\u677f\u5931\u8d25", "TEMPLATE_FAILED")
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+// cssURLEscaper escapes characters that would end a single quoted CSS url()
+var cssURLEscaper = strings.NewReplacer(`\`, `\\`, `'`, `\'`, "\n", `\a `)
+
+// serveImageCSS responds with a CSS rule that uses the image, e.g. for a random header background
+func serveImageCSS(w http.ResponseWriter, config *Config, imagePath string) {
+	rule := fmt.Sprintf("%s: url('%s');", config.CSSProperty, cssURLEscaper.Replace(imageURL(config, imagePath)))
+	if config.CSSSelector != "" {
+		rule = fmt.Sprintf("%s { %s }", config.CSSSelector, rule)
+	}
+	w.Header().Set("Content-Type", "text/css; charset=utf-8")
+	fmt.Fprintln(w, rule)
+}
+
+// imageXML is the document returned in xml mode
+type imageXML struct {
+	XMLName  xml.Name `xml:"image"`
+	Filename string   `xml:"filename"`
+	URL      string   `xml:"url"`
+	Size     int64    `xml:"size"`
+}
+
+// serveImageXML responds with the image metadata as an XML document, linked to xslt_path when configured
+func serveImageXML(w http.ResponseWriter, config *Config, selected imageFile) {
+	body, err := xml.Marshal(imageXML{
+		Filename: selected.Entry.Name(),
+		URL:      imageURL(config, selected.Path()),
+		Size:     selected.Size,
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "\u751f\u6210 XML \u5931\u8d25", "XML_FAILED")
+		return
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	if config.XSLTPath != "" {
+		buf.WriteString(`<?xml-stylesheet type="text/xsl" href="`)
+		xml.EscapeText(&buf, []byte(config.XSLTPath))
+		buf.WriteString("\"?>\n")
+	}
+	buf.Write(body)
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+// resolveImageDir returns the image directory for the request's "source" parameter.
+// It returns "" for an unknown source when strict_source_mode is enabled.
+func resolveImageDir(r *http.Request, config *Config) string {
+	return sourceDir(config, r.URL.Query().Get("source"))
+}
+
+// sourceDir returns the image directory of a source name, or "" for an unknown source in strict_source_mode.
+// An exact param_source_mapping key wins over glob keys, which are tried in sorted order.
+func sourceDir(config *Config, source string) string {
+	if customDir, exists := config.ParamSourceMapping[source]; exists {
+		return customDir
+	}
+	for _, pattern := range config.sourcePatterns {
+		if matched, _ := filepath.Match(pattern, source); matched && source != "" {
+			return config.ParamSourceMapping[pattern]
+		}
+	}
+	if source != "" && *config.StrictSourceMode {
+		return ""
+	}
+	return config.ImageDir
+}
+
+// writeUnknownSource responds with 404 for a source that is not in param_source_mapping, as JSON if the client accepts it
+func writeUnknownSource(w http.ResponseWriter, r *http.Request) {
+	for _, mediaType := range acceptedTypes(r.Header.Get("Accept")) {
+		if mediaType == "application/json" {
+			writeErrorAs(w, "json", http.StatusNotFound, "unknown source", "UNKNOWN_SOURCE")
+			return
+		}
+	}
+	writeError(w, http.StatusNotFound, "unknown source", "UNKNOWN_SOURCE")
+}
+
+// serveImageEvents streams the URL of a freshly selected image as a server-sent event every sse_interval
+func serveImageEvents(w http.ResponseWriter, r *http.Request, config *Config, imageDir string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "\u4e0d\u652f\u6301\u6d41\u5f0f\u54cd\u5e94", "STREAMING_UNSUPPORTED")
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	setNoCache(w)
+	w.Header().Set("Connection", "keep-alive")
+
+	ticker := time.NewTicker(config.SSEInterval)
+	defer ticker.Stop()
+	for {
+		if result, err := selectImage(config, imageDir); err == nil {
+			fmt.Fprintf(w, "data: %s\n\n", imageURL(config, result.FilePath))
+			flusher.Flush()
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// serveImageBatch responds with the URLs of up to count distinct images picked at random from validFiles, as JSON
+func serveImageBatch(w http.ResponseWriter, config *Config, validFiles []imageFile, count int) {
+	urls := make([]string, 0, count)
+	for _, i := range rand.Perm(len(validFiles)) {
+		if len(urls) == count {
+			break
+		}
+		urls = append(urls, imageURL(config, validFiles[i].Path()))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	setNoCache(w)
+	json.NewEncoder(w).Encode(map[string][]string{"images": urls})
+}
+
+// setNoCache marks a generated response as uncacheable, with Pragma and Expires for HTTP/1.0 proxies that ignore Cache-Control
+func setNoCache(w http.ResponseWriter) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	w.Header().Set("Expires", "0")
+}
+
+// errNoImages is returned by selectImage when no candidate image is left
+var errNoImages = errors.New("no valid images found")
+
+// SelectionResult is the outcome of picking an image, independent of how it is served
+type SelectionResult struct {
+	FilePath string
+	Mode     string
+	Err      error
+
+	File imageFile   // the selected file
+	Next *imageFile  // the file served after File in sequential mode
+	Pool []imageFile // the candidates File was picked from
+}
+
+// selectImage scans imageDir, narrows the candidates with filters and picks
+// one according to config.Mode. It touches no HTTP state, so per-request
+// behaviour such as shuffle sessions is left to the caller.
+func selectImage(config *Config, imageDir string, filters ...func([]imageFile) []imageFile) (SelectionResult, error) {
+	result := SelectionResult{Mode: config.Mode}
+	files, err := server.scan(config, imageDir)
+	if err != nil {
+		result.Err = err
+		return result, err
+	}
+	for _, filter := range filters {
+		files = filter(files)
+	}
+	if len(files) == 0 {
+		result.Err = errNoImages
+		return result, errNoImages
+	}
+
+	result.Pool = files
+	switch {
+	case len(files) == 1:
+		result.File = files[0]
+	case config.Mode == "sequential":
+		var next imageFile
+		result.File, next = server.nextSequential(imageDir, files)
+		result.Next = &next
+	default:
+		result.File = files[rand.Intn(len(files))]
+	}
+	result.FilePath = result.File.Path()
+	return result, nil
+}
+
+// handleImageRequest processes the image request logic
+func handleImageRequest(w http.ResponseWriter, r *http.Request, config *Config, imageDir string) {
+	setRobotsTag(w, config)
+	if config.Mode == "sse" {
+		serveImageEvents(w, r, config, imageDir)
+		return
+	}
+
+	start := time.Now()
+	count := 0
+	if param := r.URL.Query().Get("count"); param != "" {
+		n, err := strconv.Atoi(param)
+		if err != nil || n < 1 || n > *config.MaxBatchSize {
+			// count answers are always JSON, so its errors are too
+			writeErrorAs(w, "json", http.StatusBadRequest, fmt.Sprintf("count must be a positive integer between 1 and %d", *config.MaxBatchSize), "INVALID_COUNT")
+			return
+		}
+		count = n
+	}
+	var filters []func([]imageFile) []imageFile
+	if ext := r.URL.Query().Get("ext"); ext != "" {
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		if !*config.DisableFileTypeCheck && !isValidExtension(ext, config.extSetFor(imageDir), *config.CaseSensitiveExtensions) {
+			writeError(w, http.StatusBadRequest, "\u4e0d\u652f\u6301\u7684\u6269\u5c55\u540d", "UNSUPPORTED_EXTENSION")
+			return
+		}
+		filters = append(filters, func(files []imageFile) []imageFile {
+			return filterByExtension(files, ext, *config.CaseSensitiveExtensions)
+		})
+	}
+	filters = append(filters, func(files []imageFile) []imageFile {
+		return server.applyPreSelect(r, files)
+	})
+	// A batch asks for several distinct images, so it is not narrowed to the single recommended one
+	if *config.Recommendation.Enabled && count == 0 {
+		w.Header().Add("Vary", "X-Theme")
+		filters = append(filters, recommendationFilter(r, config))
+	}
+
+	// The directory scan cannot be interrupted, so a cancelled request is dropped before and after it
+	if r.Context().Err() != nil {
+		return
+	}
+	result, err := selectImage(config, imageDir, filters...)
+	if r.Context().Err() != nil {
+		return
+	}
+	switch {
+	case errors.Is(err, errNoImages):
+		if *config.Placeholder {
+			servePlaceholder(w, config)
+			return
+		}
+		writeError(w, http.StatusNotFound, "\u6ca1\u6709\u627e\u5230\u6709\u6548\u7684\u56fe\u7247", "NO_IMAGES")
+		return
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, "\u65e0\u6cd5\u8bfb\u53d6\u56fe\u7247\u76ee\u5f55", "READ_DIR_FAILED")
+		return
+	}
+
+	validFiles := result.Pool
+	if count > 0 {
+		serveImageBatch(w, config, validFiles, count)
+		return
+	}
+	selected := result.File
+	switch {
+	case len(validFiles) > 1 && config.Mode == "shuffle":
+		selected = nextShuffled(w, r, config, imageDir, validFiles)
+	case result.Next != nil:
+		w.Header().Add("Link", fmt.Sprintf("<%s>; rel=\"preload\"; as=\"image\"", imageURL(config, result.Next.Path())))
+	}
+	selected = server.applyPostSelect(r, selected)
+	imagePath := selected.Path()
+	switch config.Mode {
+	case "redir":
+		etag := redirectETag(selected)
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			break
+		}
+		serveImageRedirect(w, r, imageURL(config, imagePath))
+	case "redirect_signed":
+		serveSignedRedirect(w, r, config, selected.Entry.Name())
+	case "html":
+		w.Header().Set("Last-Modified", selected.ModTime.UTC().Format(http.TimeFormat))
+		serveImageHTML(w, config, imagePath)
+	case "css":
+		w.Header().Set("Last-Modified", selected.ModTime.UTC().Format(http.TimeFormat))
+		serveImageCSS(w, config, imagePath)
+	case "xml":
+		w.Header().Set("Last-Modified", selected.ModTime.UTC().Format(http.TimeFormat))
+		serveImageXML(w, config, selected)
+	case "thumbnail":
+		serveThumbnail(w, r, config, imagePath)
+	default:
+		setContentDisposition(w, imagePath)
+		if *config.AllowQueryResize {
+			params, ok, err := parseResizeParams(r, config)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err.Error(), "INVALID_RESIZE")
+				return
+			}
+			if ok {
+				serveResizedImage(w, r, config, imagePath, params)
+				break
+			}
+		}
+		if *config.AVIFEnabled && serveAVIF(w, r, config, imagePath) {
+			break
+		}
+		serveImageFile(w, r, imagePath, selected.MimeType)
+	}
+
+	if config.LogLevel == "debug" {
+		server.logger().Debug("image selected",
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.String("source_param", r.URL.Query().Get("source")),
+			slog.String("resolved_dir", imageDir),
+			slog.Int("pool_size", len(validFiles)),
+			slog.String("selected_file", imagePath),
+			slog.String("mode", config.Mode),
+			slog.Float64("latency_ms", float64(time.Since(start).Microseconds())/1000),
+		)
+	}
+}
+
+// versionString returns the human readable build information
+func versionString() string {
+	return fmt.Sprintf("monikim v%s (%s) built at %s", version, runtime.Version(), buildTime)
+}
+
+// handleVersion reports the build information as JSON
+func handleVersion(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"version":    version,
+		"go_version": runtime.Version(),
+		"build_time": buildTime,
+	})
+}
+
+// acceptedTypes returns the media types of an Accept header, most preferred first
+func acceptedTypes(accept string) []string {
+	type mediaRange struct {
+		mediaType string
+		q         float64
+	}
+	var ranges []mediaRange
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(fields[0]))
+		if mediaType == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if value, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = value
+				}
+			}
+		}
+		ranges = append(ranges, mediaRange{mediaType, q})
+	}
+	sort.SliceStable(ranges, func(i, j int) bool { return ranges[i].q > ranges[j].q })
+
+	types := make([]string, 0, len(ranges))
+	for _, mr := range ranges {
+		if mr.q > 0 {
+			types = append(types, mr.mediaType)
+		}
+	}
+	return types
+}
+
+// handleFavicon serves the favicon variant that best matches the Accept header, falling back to FaviconPath
+func handleFavicon(w http.ResponseWriter, r *http.Request, config *Config) {
+	w.Header().Add("Vary", "Accept")
+	for _, mediaType := range acceptedTypes(r.Header.Get("Accept")) {
+		if path, exists := config.Favicons[mediaType]; exists {
+			w.Header().Set("Content-Type", mediaType)
+			serveImageFile(w, r, path, "")
+			return
+		}
+	}
+	if config.FaviconPath != "" {
+		serveImageFile(w, r, config.FaviconPath, "")
+		return
+	}
+	http.NotFound(w, r)
+}
+
+// main is the entry point of the application
+func main() {
+	showVersion := flag.Bool("version", false, "print version information and exit")
+	configFlag := flag.String("config", "", "path to the config file (default $MONIKIM_CONFIG, or the merged files found by config discovery)")
+	showConfigPath := flag.Bool("show-config-path", false, "print the config files that would be loaded and exit")
+	listSources := flag.Bool("list-sources", false, "print every configured source with its file count and exit")
+	checkConfig := flag.Bool("check-config", false, "validate the config without touching image directories, print every problem and exit")
+	dryRun := flag.Bool("dry-run", false, "load and validate the config, then exit without serving")
+	initFiles := flag.Bool("init", false, "write config.example.yaml and config.schema.json to the working directory and exit")
+	genOpenAPI := flag.Bool("gen-openapi", false, "print the OpenAPI spec of the HTTP endpoints and exit")
+	showConfigTemplate := flag.Bool("config-template", false, "print a commented config.yaml with every setting at its default value and exit")
+	listPresets := flag.Bool("list-presets", false, "print the built-in presets and the settings they change, then exit")
+	output := flag.String("output", "text", "output format of --list-presets: text or markdown")
+	bench := flag.Bool("bench", false, "benchmark image selection for 5 seconds and print the results before serving")
+	benchMinRPS := flag.Float64("bench-min-rps", 0, "with --bench, exit with code 2 if the measured requests/second is below this")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s:\n", os.Args[0])
+		flag.PrintDefaults()
+		printPresets(flag.CommandLine.Output())
+	}
+	flag.Parse()
+
+	if *showVersion || flag.Arg(0) == "version" {
+		fmt.Println(versionString())
+		return
+	}
+	if *initFiles {
+		os.Exit(runInit())
+	}
+	if *genOpenAPI {
+		fmt.Print(openAPISpec)
+		return
+	}
+	if *showConfigTemplate {
+		fmt.Print(configTemplate)
+		return
+	}
+	if *listPresets {
+		os.Exit(runListPresets(*output))
+	}
+
+	// An explicit config skips discovery; otherwise every discovered file is merged, later ones winning
+	var configPaths []string
+	switch env := os.Getenv("MONIKIM_CONFIG"); {
+	case *configFlag != "":
+		configPaths = []string{*configFlag}
+	case env != "":
+		configPaths = []string{env}
+	default:
+		configPaths = discoverConfigPaths()
+	}
+	if *showConfigPath {
+		if len(configPaths) == 0 {
+			fmt.Fprintf(os.Stderr, "no config file found in %s\n", strings.Join(configSearchPaths(), ", "))
+			os.Exit(1)
+		}
+		for _, path := range configPaths {
+			fmt.Println(path)
+		}
+		return
+	}
+	if len(configPaths) == 0 {
+		configPaths = []string{"config.yaml"}
+	}
+
+	if flag.Arg(0) == "pick" {
+		os.Exit(runPick(configPaths, flag.Args()[1:]))
+	}
+	if *listSources {
+		os.Exit(runListSources(configPaths))
+	}
+	if *checkConfig {
+		os.Exit(runCheckConfig(configPaths))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	config, err := loadConfigWithContext(ctx, configPaths...)
+	cancel()
+	if err != nil {
+		fatal("\u52a0\u8f7d\u914d\u7f6e\u5931\u8d25", err)
+	}
+
+	server.Logger = newLogger(config.LogLevel)
+	server.MaxHeaderBytes = *config.MaxHeaderBytes
+	server.DisableKeepAlives = *config.DisableKeepAlives
+
+	if err := prepareConfig(config); err != nil {
+		fatal("\u914d\u7f6e\u65e0\u6548", err)
+	}
+	if *config.DisableFileTypeCheck && !*config.SuppressDisableFileTypeCheckWarning {
+		server.logger().Warn("WARNING: disable_file_type_check is enabled; all files in image_dir will be served regardless of type")
+	}
+	if *config.AVIFEnabled && !avifSupported {
+		server.logger().Warn("avif_enabled is set but this build has no libvips (build with -tags vips); original images will be served")
+	}
+	if *dryRun {
+		fmt.Println("\u914d\u7f6e\u6709\u6548")
+		return
+	}
+	currentConfig.Store(config)
+
+	contentLRU = newContentCache(*config.ContentCacheSize)
+	if *bench {
+		if code := runBench(config, 5*time.Second, *benchMinRPS); code != 0 {
+			os.Exit(code)
+		}
+	}
+
+	reloadOnSIGHUP(configPaths)
+	if *config.ConfigWatchEnabled {
+		if err := watchConfigFiles(configPaths); err != nil {
+			fatal("\u65e0\u6cd5\u76d1\u542c\u914d\u7f6e\u6587\u4ef6", err)
+		}
+	}
+
+	go reapSessions(config.SessionGCInterval)
+	go reapThumbnails(config.ThumbnailCleanupInterval)
+	if *config.GeoBlock.Enabled {
+		// The database is opened once; changing db_path takes a restart
+		if geoDB, err = geoip2.Open(config.GeoBlock.DBPath); err != nil {
+			fatal("\u65e0\u6cd5\u6253\u5f00 GeoIP \u6570\u636e\u5e93", err)
+		}
+	}
+	if config.GRPCPort != "" {
+		go func() {
+			if err := serveGRPC(config.GRPCPort); err != nil {
+				fatal("gRPC \u670d\u52a1\u542f\u52a8\u5931\u8d25", err)
+			}
+		}()
+	}
+
+	// Selection hooks are registered here, e.g.
+	// server.PreSelectHooks = append(server.PreSelectHooks, FilterBySizeHook(0, 5<<20))
+	// server.PostSelectHooks = append(server.PostSelectHooks, LoggingHook)
+
+	handler := withServerHeader(withClientChecks(newServeMux(config)))
+	handler = withStats(handler, stats)
+	if config.AccessLog != "" {
+		accessLog, err := newAccessLog(config.AccessLog, config.AccessLogFormat)
+		if err != nil {
+			fatal("\u65e0\u6cd5\u6253\u5f00\u8bbf\u95ee\u65e5\u5fd7", err)
+		}
+		accessLog.reopenOnSIGHUP()
+		handler = withAccessLog(handler, accessLog)
+	}
+	handler = withConcurrencyLimit(handler, *config.MaxConcurrentRequests)
+	if err := server.ListenAndServe(config.Port, handler); err != nil {
+		fatal("\u670d\u52a1\u5668\u542f\u52a8\u5931\u8d25", err)
+	}
+}
+
+// newServeMux registers every endpoint enabled by config; handlers read the current config on each request, but
+// which endpoints exist is fixed by the config the server started with
+func newServeMux(config *Config) *http.ServeMux {
+	mux := http.NewServeMux()
+	// handler_path is registered once; changing it requires a restart
+	mux.HandleFunc(config.HandlerPath, func(w http.ResponseWriter, r *http.Request) {
+		config := currentConfig.Load()
+		if allowed := imageMethods(config); !contains(allowed, r.Method) {
+			w.Header().Set("Allow", strings.Join(allowed, ", "))
+			writeError(w, http.StatusMethodNotAllowed, "405 Method Not Allowed", "METHOD_NOT_ALLOWED")
+			return
+		}
+		imageDir := resolveImageDir(r, config)
+		if imageDir == "" {
+			writeUnknownSource(w, r)
+			return
+		}
+		handleCORS(w, r, config)
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		handleImageRequest(w, r, config, imageDir)
+	})
+
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+
+	mux.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
+		if err := checkImageDir("image_dir", currentConfig.Load().ImageDir); err != nil {
+			writeError(w, http.StatusServiceUnavailable, "not ready", "NOT_READY")
+			return
+		}
+		fmt.Fprintln(w, "ready")
+	})
+
+	mux.HandleFunc("/robots.txt", func(w http.ResponseWriter, r *http.Request) {
+		config := currentConfig.Load()
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprint(w, config.RobotsTxt)
+	})
+
+	mux.HandleFunc("/favicon.ico", func(w http.ResponseWriter, r *http.Request) {
+		handleFavicon(w, r, currentConfig.Load())
+	})
+
+	mux.HandleFunc("/openapi.yaml", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/yaml")
+		fmt.Fprint(w, openAPISpec)
+	})
+
+	if config.Mode == "redirect_signed" {
+		mux.HandleFunc("/verify", func(w http.ResponseWriter, r *http.Request) {
+			handleVerify(w, r, currentConfig.Load())
+		})
+	}
+
+	if *config.VersionEndpointEnabled {
+		mux.HandleFunc("/version", handleVersion)
+	}
+
+	if *config.StatsEndpointEnabled {
+		mux.HandleFunc("/stats", handleStats)
+	}
+
+	if *config.ListEndpointEnabled {
+		mux.HandleFunc("/list", func(w http.ResponseWriter, r *http.Request) {
+			handleList(w, r, currentConfig.Load())
+		})
+	}
+
+	if config.AdminToken != "" {
+		mux.HandleFunc("/admin/shutdown", func(w http.ResponseWriter, r *http.Request) {
+			handleShutdown(w, r, currentConfig.Load())
+		})
+	}
+
+	if *config.SchemaEndpointEnabled {
+		mux.HandleFunc("/schema", handleSchema)
+	}
+
+	if *config.WebSocket {
+		mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+			handleWebSocket(w, r, currentConfig.Load())
+		})
+	}
+	return mux
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// configPreset is a built-in named configuration template selected with the preset setting
+type configPreset struct {
+	Description string
+	Config      func() *Config
+}
+
+// configPresets are the built-in presets. A preset only sets fields; everything set in the config files overrides it,
+// and fields neither sets keep their usual defaults.
+var configPresets = map[string]configPreset{
+	"development": {
+		Description: "local development: debug logging, any origin, no referer check, introspection endpoints and config reloads",
+		Config: func() *Config {
+			return &Config{
+				LogLevel:               "debug",
+				CorsEnabled:            boolPtr(true),
+				AllowedOrigins:         []string{"*"},
+				RefererCheckEnabled:    boolPtr(false),
+				ConfigWatchEnabled:     boolPtr(true),
+				VersionEndpointEnabled: boolPtr(true),
+				StatsEndpointEnabled:   boolPtr(true),
+				ListEndpointEnabled:    boolPtr(true),
+				SchemaEndpointEnabled:  boolPtr(true),
+				ErrorFormat:            "json",
+			}
+		},
+	},
+	"cdn": {
+		Description: "origin behind a CDN: CORS for every origin, cache headers readable by scripts, scanners blocked, a large content cache",
+		Config: func() *Config {
+			return &Config{
+				CorsEnabled:      boolPtr(true),
+				AllowedOrigins:   []string{"*"},
+				ExposedHeaders:   []string{"ETag", "Last-Modified", "X-Cache"},
+				BlockBadBots:     boolPtr(true),
+				ContentCacheSize: intPtr(1024),
+			}
+		},
+	},
+	"strict": {
+		Description: "locked down: referer check (set allowed_referers), strict sources, scanners blocked, low concurrency and batch limits, no introspection endpoints",
+		Config: func() *Config {
+			return &Config{
+				RefererCheckEnabled:    boolPtr(true),
+				StrictSourceMode:       boolPtr(true),
+				BlockBadBots:           boolPtr(true),
+				MaxConcurrentRequests:  intPtr(100),
+				MaxBatchSize:           intPtr(5),
+				MaxWSConnections:       intPtr(10),
+				AllowQueryResize:       boolPtr(false),
+				VersionEndpointEnabled: boolPtr(false),
+				StatsEndpointEnabled:   boolPtr(false),
+				ListEndpointEnabled:    boolPtr(false),
+				SchemaEndpointEnabled:  boolPtr(false),
+			}
+		},
+	},
+}
+
+// applyPreset returns config laid over its preset; configs without a known preset are returned unchanged and an
+// unknown name is reported by validation
+func applyPreset(config *Config) *Config {
+	preset, ok := configPresets[config.Preset]
+	if !ok {
+		return config
+	}
+	return mergeConfigs(preset.Config(), config)
+}
+
+// presetSettings lists the settings a preset changes from the defaults as "yaml_key: value" lines, in field order
+func presetSettings(config *Config) []string {
+	var settings []string
+	value := reflect.ValueOf(config).Elem()
+	defaults := reflect.ValueOf((&Config{}).WithDefaults()).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		key, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if !field.IsExported() || key == "" || value.Field(i).IsZero() {
+			continue
+		}
+		if reflect.DeepEqual(reflect.Indirect(value.Field(i)).Interface(), reflect.Indirect(defaults.Field(i)).Interface()) {
+			continue
+		}
+		encoded, err := json.Marshal(value.Field(i).Interface())
+		if err != nil {
+			continue
+		}
+		settings = append(settings, fmt.Sprintf("%s: %s", key, encoded))
+	}
+	return settings
+}
+
+// presetNames returns the names of the built-in presets in sorted order
+func presetNames() []string {
+	names := make([]string, 0, len(configPresets))
+	for name := range configPresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// printPresets writes every preset with the settings it changes, for --help
+func printPresets(w io.Writer) {
+	fmt.Fprintln(w, "\nPresets (preset: <name>; settings in the config files override them):")
+	for _, name := range presetNames() {
+		fmt.Fprintf(w, "  %s: %s\n", name, configPresets[name].Description)
+		for _, setting := range presetSettings(configPresets[name].Config()) {
+			fmt.Fprintf(w, "      %s\n", setting)
+		}
+	}
+}
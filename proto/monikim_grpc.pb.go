@@ -0,0 +1,127 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: monikim.proto
+
+package monikimpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	MoniKim_GetRandomImage_FullMethodName = "/monikim.MoniKim/GetRandomImage"
+)
+
+// MoniKimClient is the client API for MoniKim service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// MoniKim selects images the same way the HTTP endpoint does, without the HTTP round trip
+type MoniKimClient interface {
+	// GetRandomImage picks one image from a source
+	GetRandomImage(ctx context.Context, in *GetImageRequest, opts ...grpc.CallOption) (*GetImageResponse, error)
+}
+
+type moniKimClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewMoniKimClient(cc grpc.ClientConnInterface) MoniKimClient {
+	return &moniKimClient{cc}
+}
+
+func (c *moniKimClient) GetRandomImage(ctx context.Context, in *GetImageRequest, opts ...grpc.CallOption) (*GetImageResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(GetImageResponse)
+	err := c.cc.Invoke(ctx, MoniKim_GetRandomImage_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// MoniKimServer is the server API for MoniKim service.
+// All implementations must embed UnimplementedMoniKimServer
+// for forward compatibility.
+//
+// MoniKim selects images the same way the HTTP endpoint does, without the HTTP round trip
+type MoniKimServer interface {
+	// GetRandomImage picks one image from a source
+	GetRandomImage(context.Context, *GetImageRequest) (*GetImageResponse, error)
+	mustEmbedUnimplementedMoniKimServer()
+}
+
+// UnimplementedMoniKimServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedMoniKimServer struct{}
+
+func (UnimplementedMoniKimServer) GetRandomImage(context.Context, *GetImageRequest) (*GetImageResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetRandomImage not implemented")
+}
+func (UnimplementedMoniKimServer) mustEmbedUnimplementedMoniKimServer() {}
+func (UnimplementedMoniKimServer) testEmbeddedByValue()                 {}
+
+// UnsafeMoniKimServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to MoniKimServer will
+// result in compilation errors.
+type UnsafeMoniKimServer interface {
+	mustEmbedUnimplementedMoniKimServer()
+}
+
+func RegisterMoniKimServer(s grpc.ServiceRegistrar, srv MoniKimServer) {
+	// If the following call pancis, it indicates UnimplementedMoniKimServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&MoniKim_ServiceDesc, srv)
+}
+
+func _MoniKim_GetRandomImage_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetImageRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MoniKimServer).GetRandomImage(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: MoniKim_GetRandomImage_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MoniKimServer).GetRandomImage(ctx, req.(*GetImageRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// MoniKim_ServiceDesc is the grpc.ServiceDesc for MoniKim service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var MoniKim_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "monikim.MoniKim",
+	HandlerType: (*MoniKimServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetRandomImage",
+			Handler:    _MoniKim_GetRandomImage_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "monikim.proto",
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// RecommendationConfig asks an external inference service, such as a CLIP-based ranker, which image best fits
+// the theme a client sends in the X-Theme header
+type RecommendationConfig struct {
+	Enabled  *bool         `yaml:"enabled"`
+	Endpoint string        `yaml:"endpoint"`
+	Timeout  time.Duration `yaml:"timeout"`
+}
+
+// recommendationClient sends the ranking requests; each request is bounded by recommendation.timeout instead of a client timeout
+var recommendationClient = &http.Client{}
+
+// rankImages posts the candidate file names to the recommendation endpoint, forwarding the theme as X-Theme,
+// and returns the file names the service ranked, best first
+func rankImages(ctx context.Context, config *Config, theme string, files []imageFile) ([]string, error) {
+	names := make([]string, len(files))
+	for i, file := range files {
+		names[i] = file.Entry.Name()
+	}
+	body, err := json.Marshal(names)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, config.Recommendation.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, config.Recommendation.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Theme", theme)
+	resp, err := recommendationClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("recommendation service returned %s", resp.Status)
+	}
+	var ranked []string
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&ranked); err != nil {
+		return nil, fmt.Errorf("invalid recommendation response: %w", err)
+	}
+	return ranked, nil
+}
+
+// recommendationFilter narrows the candidates to the service's top-ranked file for r's X-Theme.
+// Requests without a theme, and any failure or unknown ranking, leave the candidates to random selection.
+func recommendationFilter(r *http.Request, config *Config) func([]imageFile) []imageFile {
+	return func(files []imageFile) []imageFile {
+		theme := r.Header.Get("X-Theme")
+		if theme == "" || len(files) == 0 {
+			return files
+		}
+		ranked, err := rankImages(r.Context(), config, theme, files)
+		if err != nil {
+			server.logger().Warn("\u63a8\u8350\u670d\u52a1\u4e0d\u53ef\u7528\uff0c\u6539\u4e3a\u968f\u673a\u9009\u62e9", "error", err)
+			return files
+		}
+		for _, name := range ranked {
+			for _, file := range files {
+				if file.Entry.Name() == name {
+					return []imageFile{file}
+				}
+			}
+		}
+		return files
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// currentConfig is the active configuration; reloads replace it atomically so requests never see a half-updated config.
+// A stored Config, including maps such as ParamSourceMapping, is never modified: reloads decode and prepare a new one,
+// and handlers load the pointer once per request and pass that snapshot down.
+var currentConfig atomic.Pointer[Config]
+
+// readListFile reads a newline separated list file, skipping blank lines and lines starting with "#"
+func readListFile(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries = append(entries, line)
+	}
+	return entries, scanner.Err()
+}
+
+// loadListFiles merges the entries of allowed_referers_file and allowed_origins_file into the YAML lists
+func loadListFiles(config *Config) error {
+	if config.AllowedReferersFile != "" {
+		entries, err := readListFile(config.AllowedReferersFile)
+		if err != nil {
+			return fmt.Errorf("\u65e0\u6cd5\u8bfb\u53d6 allowed_referers_file: %v", err)
+		}
+		config.AllowedReferers = append(config.AllowedReferers, entries...)
+	}
+	if config.AllowedOriginsFile != "" {
+		entries, err := readListFile(config.AllowedOriginsFile)
+		if err != nil {
+			return fmt.Errorf("\u65e0\u6cd5\u8bfb\u53d6 allowed_origins_file: %v", err)
+		}
+		config.AllowedOrigins = append(config.AllowedOrigins, entries...)
+	}
+	return nil
+}
+
+// prepareConfig completes a freshly loaded config: it merges the list files, validates and compiles it and expands glob patterns
+func prepareConfig(config *Config) error {
+	if err := loadListFiles(config); err != nil {
+		return err
+	}
+	if err := validateConfig(config); err != nil {
+		return err
+	}
+	if err := config.compile(); err != nil {
+		return err
+	}
+	config.expandImageDirs()
+	return nil
+}
+
+// reloadConfig loads the config files again and swaps them in; the old config stays active if the new one is invalid
+func reloadConfig(configPaths []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	config, err := loadConfigWithContext(ctx, configPaths...)
+	if err != nil {
+		return err
+	}
+	if err := prepareConfig(config); err != nil {
+		return err
+	}
+	currentConfig.Store(config)
+	server.logger().Info("\u914d\u7f6e\u5df2\u91cd\u65b0\u52a0\u8f7d", slog.String("config", strings.Join(configPaths, ", ")))
+	return nil
+}
+
+// reloadOnSIGHUP reloads the config every time the process receives SIGHUP
+func reloadOnSIGHUP(configPaths []string) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			if err := reloadConfig(configPaths); err != nil {
+				server.logger().Error("\u91cd\u65b0\u52a0\u8f7d\u914d\u7f6e\u5931\u8d25", slog.Any("error", err))
+			}
+		}
+	}()
+}
+
+// watchConfigFiles reloads the config whenever one of the config files or list files changes
+func watchConfigFiles(configPaths []string) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	// Watch the parent directories rather than the files, so editors and tools that replace files by renaming are noticed too
+	watched := make(map[string]bool)
+	config := currentConfig.Load()
+	for _, path := range append(configPaths[:len(configPaths):len(configPaths)], config.AllowedReferersFile, config.AllowedOriginsFile) {
+		if path == "" || isRemoteConfig(path) {
+			continue
+		}
+		absPath, err := filepath.Abs(path)
+		if err != nil {
+			continue
+		}
+		watched[absPath] = true
+		if err := watcher.Add(filepath.Dir(absPath)); err != nil {
+			watcher.Close()
+			return err
+		}
+	}
+
+	go func() {
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				absPath, _ := filepath.Abs(event.Name)
+				if !watched[absPath] || !event.Has(fsnotify.Write|fsnotify.Create|fsnotify.Rename) {
+					continue
+				}
+				if err := reloadConfig(configPaths); err != nil {
+					server.logger().Error("\u91cd\u65b0\u52a0\u8f7d\u914d\u7f6e\u5931\u8d25", slog.Any("error", err))
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				server.logger().Error("\u914d\u7f6e\u6587\u4ef6\u76d1\u542c\u51fa\u9519", slog.Any("error", err))
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestConcurrentReloadKeepsSnapshotsConsistent(t *testing.T) {
+	logger := server.Logger
+	server.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	t.Cleanup(func() { server.Logger = logger })
+
+	// Each config maps cats and its own marker source to the same directory, so a snapshot mixing the two is detectable
+	dirs := map[string]string{"a": setupTestDir(t), "b": setupTestDir(t)}
+	configPaths := make(map[string][]string)
+	for name, dir := range dirs {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		yaml := fmt.Sprintf("image_dir: %q\nparam_source_mapping:\n  cats: %q\n  only-%s: %q\n", dir, dir, name, dir)
+		if err := os.WriteFile(path, []byte(yaml), 0644); err != nil {
+			t.Fatal(err)
+		}
+		configPaths[name] = []string{path}
+	}
+	saved := currentConfig.Load()
+	t.Cleanup(func() { currentConfig.Store(saved) })
+	if err := reloadConfig(configPaths["a"]); err != nil {
+		t.Fatal(err)
+	}
+	handler := withClientChecks(newServeMux(currentConfig.Load()))
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			if err := reloadConfig(configPaths[[]string{"a", "b"}[i%2]]); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				config := currentConfig.Load()
+				for name, dir := range dirs {
+					if config.ParamSourceMapping["cats"] != dir {
+						continue
+					}
+					if len(config.ParamSourceMapping) != 2 || config.ParamSourceMapping["only-"+name] != dir {
+						t.Errorf("snapshot mixes configs: %v", config.ParamSourceMapping)
+						return
+					}
+				}
+				if w := serve(handler, http.MethodGet, "/?source=cats", nil); w.Code != http.StatusOK {
+					t.Errorf("GET /?source=cats during reload = %d", w.Code)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
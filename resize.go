@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// resizeParams holds the transformation requested through the w, h and q query parameters
+type resizeParams struct {
+	Width   int
+	Height  int
+	Quality int
+}
+
+// parseResizeParams reads and validates the w, h and q query parameters; ok is false when none of them is present
+func parseResizeParams(r *http.Request, config *Config) (params resizeParams, ok bool, err error) {
+	query := r.URL.Query()
+	if query.Get("w") == "" && query.Get("h") == "" && query.Get("q") == "" {
+		return params, false, nil
+	}
+
+	parse := func(name string, max int) (int, error) {
+		value := query.Get(name)
+		if value == "" {
+			return 0, nil
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 || n > max {
+			return 0, fmt.Errorf("%s must be an integer between 1 and %d", name, max)
+		}
+		return n, nil
+	}
+	if params.Width, err = parse("w", *config.MaxResizeWidth); err != nil {
+		return params, true, err
+	}
+	if params.Height, err = parse("h", *config.MaxResizeHeight); err != nil {
+		return params, true, err
+	}
+	if params.Quality, err = parse("q", 100); err != nil {
+		return params, true, err
+	}
+	return params, true, nil
+}
+
+// errImageTooLarge is returned for images with more pixels than max_decode_pixels
+var errImageTooLarge = errors.New("image exceeds max_decode_pixels")
+
+// decodeImage decodes an image once its header shows it has at most maxPixels pixels, so a small file declaring
+// huge dimensions cannot make the decoder allocate its full pixel buffer
+func decodeImage(file io.ReadSeeker, maxPixels int) (image.Image, string, error) {
+	header, _, err := image.DecodeConfig(file)
+	if err != nil {
+		return nil, "", err
+	}
+	if int64(header.Width)*int64(header.Height) > int64(maxPixels) {
+		return nil, "", errImageTooLarge
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, "", err
+	}
+	return image.Decode(file)
+}
+
+// writeTransformError responds to an image that could not be decoded for resizing or thumbnailing
+func writeTransformError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errImageTooLarge) {
+		writeError(w, http.StatusUnprocessableEntity, "\u56fe\u7247\u5c3a\u5bf8\u8fc7\u5927", "IMAGE_TOO_LARGE")
+		return
+	}
+	writeError(w, http.StatusUnsupportedMediaType, "\u65e0\u6cd5\u5904\u7406\u56fe\u7247", "UNSUPPORTED_IMAGE")
+}
+
+// resizeImage decodes the image file, scales it and re-encodes it; JPEG is used for JPEG sources or when a quality is given
+func resizeImage(imagePath string, params resizeParams, maxPixels int) (cachedContent, error) {
+	file, err := os.Open(imagePath)
+	if err != nil {
+		return cachedContent{}, err
+	}
+	defer file.Close()
+
+	src, format, err := decodeImage(file, maxPixels)
+	if err != nil {
+		return cachedContent{}, err
+	}
+
+	bounds := src.Bounds()
+	width, height := params.Width, params.Height
+	switch {
+	case width == 0 && height == 0:
+		width, height = bounds.Dx(), bounds.Dy()
+	case width == 0:
+		width = max(1, bounds.Dx()*height/bounds.Dy())
+	case height == 0:
+		height = max(1, bounds.Dy()*width/bounds.Dx())
+	}
+
+	var dst image.Image = src
+	if width != bounds.Dx() || height != bounds.Dy() {
+		scaled := image.NewRGBA(image.Rect(0, 0, width, height))
+		draw.CatmullRom.Scale(scaled, scaled.Bounds(), src, bounds, draw.Over, nil)
+		dst = scaled
+	}
+
+	var buf bytes.Buffer
+	if format == "jpeg" || params.Quality > 0 {
+		quality := params.Quality
+		if quality == 0 {
+			quality = jpeg.DefaultQuality
+		}
+		if err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: quality}); err != nil {
+			return cachedContent{}, err
+		}
+		return cachedContent{ContentType: "image/jpeg", Data: buf.Bytes()}, nil
+	}
+	if err := png.Encode(&buf, dst); err != nil {
+		return cachedContent{}, err
+	}
+	return cachedContent{ContentType: "image/png", Data: buf.Bytes()}, nil
+}
+
+// serveResizedImage serves the transformed image, reusing earlier results from the content cache
+func serveResizedImage(w http.ResponseWriter, r *http.Request, config *Config, imagePath string, params resizeParams) {
+	info, err := os.Stat(imagePath)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "\u65e0\u6cd5\u8bfb\u53d6\u56fe\u7247", "READ_FAILED")
+		return
+	}
+	key := fmt.Sprintf("resize|%s|%d|%d|%d|%d", imagePath, info.ModTime().UnixNano(), params.Width, params.Height, params.Quality)
+
+	content, cached := contentLRU.Get(key)
+	// X-Cache tells CDN operators whether the resized body came from the content cache
+	w.Header().Set("X-Cache", "HIT")
+	if !cached {
+		w.Header().Set("X-Cache", "MISS")
+		content, err = resizeImage(imagePath, params, *config.MaxDecodePixels)
+		if err != nil {
+			writeTransformError(w, err)
+			return
+		}
+		contentLRU.Add(key, content)
+	}
+
+	setTranscodedDisposition(w, imagePath, content.ContentType)
+	serveCachedContent(w, r, content, info.ModTime())
+}
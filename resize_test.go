@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// pngDeclaring returns a 1x1 PNG whose IHDR chunk claims the given dimensions
+func pngDeclaring(t *testing.T, width, height uint32) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 1, 1))); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	// The IHDR chunk follows the 8 byte signature: length, type, then width and height
+	ihdr := data[8+8 : 8+8+13]
+	binary.BigEndian.PutUint32(ihdr[0:4], width)
+	binary.BigEndian.PutUint32(ihdr[4:8], height)
+	binary.BigEndian.PutUint32(data[8+8+13:], crc32.ChecksumIEEE(data[8+4:8+8+13]))
+	return data
+}
+
+func TestDecodeImageChecksDimensionsFirst(t *testing.T) {
+	_, _, err := decodeImage(bytes.NewReader(pngDeclaring(t, 100000, 100000)), 40_000_000)
+	if !errors.Is(err, errImageTooLarge) {
+		t.Fatalf("decodeImage of a 100000x100000 header = %v, want errImageTooLarge", err)
+	}
+
+	img, format, err := decodeImage(bytes.NewReader(pngDeclaring(t, 1, 1)), 1)
+	if err != nil || format != "png" || img.Bounds().Dx() != 1 {
+		t.Fatalf("decodeImage of a 1x1 PNG = %v, %q, %v", img, format, err)
+	}
+}
+
+func TestResizeMaxDecodePixels(t *testing.T) {
+	dir := setupSingleFileDir(t, "image-000.jpg")
+	for _, tc := range []struct {
+		maxPixels int
+		target    string
+		want      int
+	}{
+		// Each case asks for a different size so that no result comes from the content cache
+		{40_000_000, "/?w=4", http.StatusOK},
+		{64, "/?w=5", http.StatusOK},
+		{63, "/?w=6", http.StatusUnprocessableEntity},
+	} {
+		config := newTestConfig(t, dir, func(c *Config) {
+			c.AllowQueryResize = boolPtr(true)
+			c.MaxDecodePixels = intPtr(tc.maxPixels)
+		})
+		if w := serve(newTestHandler(t, config), http.MethodGet, tc.target, nil); w.Code != tc.want {
+			t.Errorf("max_decode_pixels %d: status = %d, want %d", tc.maxPixels, w.Code, tc.want)
+		}
+	}
+}
+
+func TestResizedFilenameMatchesContentType(t *testing.T) {
+	jpegDir := setupSingleFileDir(t, "image-000.jpg")
+	if err := os.Rename(filepath.Join(jpegDir, "image-000.jpg"), filepath.Join(jpegDir, "photo.jpeg")); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		dir, target      string
+		wantType, wantCD string
+	}{
+		{setupSingleFileDir(t, "image-000.webp"), "/?w=50&h=50", "image/png", `inline; filename="image-000.png"`},
+		{setupSingleFileDir(t, "image-000.gif"), "/?w=50", "image/png", `inline; filename="image-000.png"`},
+		{setupSingleFileDir(t, "image-000.png"), "/?w=50&q=80", "image/jpeg", `inline; filename="image-000.jpg"`},
+		{setupSingleFileDir(t, "image-000.png"), "/?w=50", "image/png", `inline; filename="image-000.png"`},
+		{jpegDir, "/?w=50", "image/jpeg", `inline; filename="photo.jpeg"`},
+	} {
+		config := newTestConfig(t, tc.dir, func(c *Config) { c.AllowQueryResize = boolPtr(true) })
+		w := serve(newTestHandler(t, config), http.MethodGet, tc.target, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d, want 200: %s", tc.target, w.Code, w.Body)
+		}
+		if got := w.Header().Get("Content-Type"); got != tc.wantType {
+			t.Errorf("%s: Content-Type = %q, want %q", tc.target, got, tc.wantType)
+		}
+		if got := w.Header().Get("Content-Disposition"); got != tc.wantCD {
+			t.Errorf("%s: Content-Disposition = %q, want %q", tc.target, got, tc.wantCD)
+		}
+	}
+}
+
+func TestResizeXCache(t *testing.T) {
+	saved := contentLRU
+	contentLRU = newContentCache(1)
+	t.Cleanup(func() { contentLRU = saved })
+
+	dir := setupSingleFileDir(t, "image-000.png")
+	config := newTestConfig(t, dir, func(c *Config) { c.AllowQueryResize = boolPtr(true) })
+	handler := newTestHandler(t, config)
+	expect := func(target, want string) {
+		t.Helper()
+		w := serve(handler, http.MethodGet, target, nil)
+		if got := w.Header().Get("X-Cache"); w.Code != http.StatusOK || got != want {
+			t.Errorf("GET %s = %d with X-Cache %q, want 200 with %q", target, w.Code, got, want)
+		}
+	}
+
+	expect("/?w=4", "MISS")
+	expect("/?w=4", "HIT")
+	expect("/?w=4", "HIT")
+
+	// A changed modification time invalidates the cached result
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(filepath.Join(dir, "image-000.png"), later, later); err != nil {
+		t.Fatal(err)
+	}
+	expect("/?w=4", "MISS")
+	expect("/?w=4", "HIT")
+
+	// With room for one entry, another size evicts it
+	expect("/?w=5", "MISS")
+	expect("/?w=4", "MISS")
+
+	if w := serve(handler, http.MethodGet, "/", nil); w.Header().Get("X-Cache") != "" {
+		t.Errorf("unresized response has X-Cache %q", w.Header().Get("X-Cache"))
+	}
+}
+
+func TestContentCacheSizeZeroDisablesCaching(t *testing.T) {
+	saved := contentLRU
+	contentLRU = newContentCache(0)
+	t.Cleanup(func() { contentLRU = saved })
+
+	config := newTestConfig(t, setupSingleFileDir(t, "image-000.png"), func(c *Config) { c.AllowQueryResize = boolPtr(true) })
+	handler := newTestHandler(t, config)
+	for i := 0; i < 2; i++ {
+		if w := serve(handler, http.MethodGet, "/?w=4", nil); w.Code != http.StatusOK || w.Header().Get("X-Cache") != "MISS" {
+			t.Errorf("GET /?w=4 #%d = %d with X-Cache %q, want 200 with MISS", i+1, w.Code, w.Header().Get("X-Cache"))
+		}
+	}
+	if len(contentLRU.items) != 0 {
+		t.Errorf("disabled cache holds %d entries", len(contentLRU.items))
+	}
+
+	config = (&Config{ImageDir: t.TempDir(), ContentCacheSize: intPtr(-1)}).WithDefaults()
+	if errs := validateFields(config); len(errs) != 1 || !strings.Contains(errs[0].Error(), "content_cache_size") {
+		t.Errorf("validateFields with content_cache_size -1 = %v, want one content_cache_size error", errs)
+	}
+}
+
+// BenchmarkServeCachedContent compares the plain GET path of serveCachedContent with http.ServeContent
+func BenchmarkServeCachedContent(b *testing.B) {
+	content := cachedContent{ContentType: "image/png", Data: bytes.Repeat([]byte{0x89}, 200<<10)}
+	modTime := time.Now()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	b.Run("serveCachedContent", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			serveCachedContent(&discardResponseWriter{header: http.Header{}}, r, content, modTime)
+		}
+	})
+	b.Run("http.ServeContent", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			w := &discardResponseWriter{header: http.Header{}}
+			w.Header().Set("Content-Type", content.ContentType)
+			http.ServeContent(w, r, "", modTime, bytes.NewReader(content.Data))
+		}
+	})
+}
+
+// BenchmarkCachedFile compares writing a cached body through CachedFile.WriteTo with the plain io.Copy baseline,
+// which hands a reader without WriteTo to the response writer's ReadFrom
+func BenchmarkCachedFile(b *testing.B) {
+	data := bytes.Repeat([]byte{0x89}, 200<<10)
+	w := &discardResponseWriter{header: http.Header{}}
+	b.Run("CachedFile", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			CachedFile{data: data}.WriteTo(w)
+		}
+	})
+	b.Run("io.Copy", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			io.Copy(w, struct{ io.Reader }{bytes.NewReader(data)})
+		}
+	})
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// Server holds the runtime state shared by the HTTP handlers
+type Server struct {
+	PreSelectHooks  []PreSelectHook
+	PostSelectHooks []PostSelectHook
+
+	// scanGroup coalesces concurrent scans of the same image directory into a single disk read
+	scanGroup singleflight.Group
+	// sequences maps an image directory to its position counter in sequential mode
+	sequences sync.Map
+
+	// Logger receives the server's structured logs; nil means slog.Default, so embedders can inject their own handler
+	Logger *slog.Logger
+
+	// MaxHeaderBytes caps the size of request headers; 0 means http.DefaultMaxHeaderBytes
+	MaxHeaderBytes int
+	// DisableKeepAlives closes every connection after one request
+	DisableKeepAlives bool
+
+	// inFlight counts the requests being handled, so a graceful shutdown can report how many it drained
+	inFlight atomic.Int64
+
+	mu         sync.Mutex
+	addr       string
+	httpServer *http.Server
+	// shutdownDone is closed when Shutdown has finished draining; shutdownOnce guards it
+	shutdownDone chan struct{}
+	shutdownOnce sync.Once
+}
+
+// logger returns the logger the server writes to
+func (s *Server) logger() *slog.Logger {
+	if s.Logger != nil {
+		return s.Logger
+	}
+	return slog.Default()
+}
+
+// ListenAndServe listens on the port and serves handler; port "0" lets the OS pick a free port, see Addr
+func (s *Server) ListenAndServe(port string, handler http.Handler) error {
+	listener, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		return err
+	}
+	httpServer := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.inFlight.Add(1)
+		defer s.inFlight.Add(-1)
+		handler.ServeHTTP(w, r)
+	}), MaxHeaderBytes: s.MaxHeaderBytes}
+	if s.DisableKeepAlives {
+		httpServer.SetKeepAlivesEnabled(false)
+	}
+	s.mu.Lock()
+	s.addr = listener.Addr().String()
+	s.httpServer = httpServer
+	s.shutdownDone = make(chan struct{})
+	done := s.shutdownDone
+	s.mu.Unlock()
+
+	_, boundPort, _ := net.SplitHostPort(listener.Addr().String())
+	s.logger().Info("\u670d\u52a1\u5668\u6b63\u5728\u542f\u52a8", slog.String("port", boundPort))
+	if err := httpServer.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	// Serve returns as soon as Shutdown starts; wait for the in-flight requests to drain
+	<-done
+	return nil
+}
+
+// Shutdown stops accepting connections and waits for in-flight requests until ctx is done; ListenAndServe then returns nil
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	httpServer, done := s.httpServer, s.shutdownDone
+	s.mu.Unlock()
+	if httpServer == nil {
+		return nil
+	}
+	err := httpServer.Shutdown(ctx)
+	s.shutdownOnce.Do(func() { close(done) })
+	return err
+}
+
+// Addr returns the address the server is bound to, or "" before ListenAndServe has bound it
+func (s *Server) Addr() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.addr
+}
+
+// server is the process wide Server; hooks are registered on it in main before the listener starts
+var server = &Server{}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// reservoirSize is the number of recent response sizes kept for the size statistics
+const reservoirSize = 1000
+
+// requestStats counts the requests handled since startup
+type requestStats struct {
+	mu       sync.Mutex
+	started  time.Time
+	total    int64
+	byMethod map[string]int64
+	byStatus map[string]int64
+
+	// sizes is a ring buffer holding the last reservoirSize response sizes; next is the slot written next
+	sizes []int64
+	next  int
+}
+
+// stats collects the counters reported at /stats
+var stats = &requestStats{
+	started:  time.Now(),
+	byMethod: make(map[string]int64),
+	byStatus: make(map[string]int64),
+}
+
+// record counts one finished request
+func (s *requestStats) record(method string, status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.total++
+	s.byMethod[method]++
+	s.byStatus[strconv.Itoa(status)]++
+}
+
+// recordSize keeps the size of one response body, evicting the oldest once the reservoir is full
+func (s *requestStats) recordSize(size int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.sizes) < reservoirSize {
+		s.sizes = append(s.sizes, size)
+		return
+	}
+	s.sizes[s.next] = size
+	s.next = (s.next + 1) % reservoirSize
+}
+
+// sizeStats returns the mean and 95th percentile of the sampled response sizes; s.mu must be held
+func (s *requestStats) sizeStats() (mean float64, p95 int64) {
+	if len(s.sizes) == 0 {
+		return 0, 0
+	}
+	sorted := append([]int64(nil), s.sizes...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	var sum int64
+	for _, size := range sorted {
+		sum += size
+	}
+	return float64(sum) / float64(len(sorted)), sorted[(len(sorted)*95+99)/100-1]
+}
+
+// snapshot returns the counters in the shape served at /stats
+func (s *requestStats) snapshot() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	byMethod := make(map[string]int64, len(s.byMethod))
+	for method, n := range s.byMethod {
+		byMethod[method] = n
+	}
+	byStatus := make(map[string]int64, len(s.byStatus))
+	for status, n := range s.byStatus {
+		byStatus[status] = n
+	}
+	meanSize, p95Size := s.sizeStats()
+	return map[string]interface{}{
+		"uptime_seconds":          int64(time.Since(s.started).Seconds()),
+		"requests_total":          s.total,
+		"requests_by_method":      byMethod,
+		"requests_by_status":      byStatus,
+		"avg_response_size_bytes": meanSize,
+		"p95_response_size_bytes": p95Size,
+	}
+}
+
+// withStats counts every request handled by next; HEAD requests are counted apart from GET.
+// Response sizes are sampled from Content-Length, or the bytes written when it is not set.
+func withStats(next http.Handler, s *requestStats) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+		status := recorder.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		s.record(r.Method, status)
+		if r.Method == http.MethodHead || status == http.StatusNotModified {
+			return
+		}
+		size := recorder.bytes
+		if n, err := strconv.ParseInt(recorder.Header().Get("Content-Length"), 10, 64); err == nil {
+			size = n
+		}
+		s.recordSize(size)
+	})
+}
+
+// handleStats reports the request counters as JSON
+func handleStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats.snapshot())
+}
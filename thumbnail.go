@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"golang.org/x/image/draw"
+)
+
+// thumbnailPath returns where the thumbnail of imagePath is cached: sha256(imagePath)_WxH.jpg in thumbnail_cache_dir
+func thumbnailPath(config *Config, imagePath string) string {
+	return filepath.Join(config.ThumbnailCacheDir, fmt.Sprintf("%x_%dx%d.jpg", sha256.Sum256([]byte(imagePath)), *config.ThumbnailWidth, *config.ThumbnailHeight))
+}
+
+// serveThumbnail serves the cached thumbnail of imagePath, rendering it first when it is missing or older than the image
+func serveThumbnail(w http.ResponseWriter, r *http.Request, config *Config, imagePath string) {
+	info, err := os.Stat(imagePath)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "\u65e0\u6cd5\u8bfb\u53d6\u56fe\u7247", "READ_FAILED")
+		return
+	}
+	thumbnail := thumbnailPath(config, imagePath)
+	w.Header().Set("X-Cache", "HIT")
+	if cached, err := os.Stat(thumbnail); err != nil || cached.ModTime().Before(info.ModTime()) {
+		w.Header().Set("X-Cache", "MISS")
+		if err := renderThumbnail(imagePath, thumbnail, *config.ThumbnailWidth, *config.ThumbnailHeight, *config.MaxDecodePixels); err != nil {
+			server.logger().Warn("\u751f\u6210\u7f29\u7565\u56fe\u5931\u8d25", "path", imagePath, "error", err)
+			writeTransformError(w, err)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	http.ServeFile(w, r, thumbnail)
+}
+
+// renderThumbnail scales the centre of the source image to exactly width\u00d7height and writes it to dst as JPEG.
+// The file is written under a temporary name and renamed, so concurrent requests never serve a partial thumbnail.
+// Sources with more than maxPixels pixels are refused with errImageTooLarge.
+func renderThumbnail(src, dst string, width, height, maxPixels int) error {
+	file, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	img, _, err := decodeImage(file, maxPixels)
+	if err != nil {
+		return err
+	}
+
+	// Crop the largest centred region with the thumbnail's aspect ratio, then scale it down
+	bounds := img.Bounds()
+	crop := bounds
+	if bounds.Dx()*height > bounds.Dy()*width {
+		cropWidth := bounds.Dy() * width / height
+		crop.Min.X += (bounds.Dx() - cropWidth) / 2
+		crop.Max.X = crop.Min.X + cropWidth
+	} else {
+		cropHeight := bounds.Dx() * height / width
+		crop.Min.Y += (bounds.Dy() - cropHeight) / 2
+		crop.Max.Y = crop.Min.Y + cropHeight
+	}
+	scaled := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(scaled, scaled.Bounds(), img, crop, draw.Src, nil)
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".thumbnail-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := jpeg.Encode(tmp, scaled, &jpeg.Options{Quality: jpeg.DefaultQuality}); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
+
+// reapThumbnails periodically removes cached thumbnails whose original image is gone
+func reapThumbnails(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		config := currentConfig.Load()
+		if config.Mode != "thumbnail" {
+			continue
+		}
+		purged, err := purgeThumbnails(config)
+		if err != nil {
+			server.logger().Warn("\u6e05\u7406\u7f29\u7565\u56fe\u5931\u8d25", "error", err)
+			continue
+		}
+		server.logger().Debug("\u5df2\u6e05\u7406\u8fc7\u671f\u7f29\u7565\u56fe", slog.Int("purged", purged))
+	}
+}
+
+// thumbnailName matches the file names written by thumbnailPath; purgeThumbnails leaves every other file alone
+var thumbnailName = regexp.MustCompile(`^([0-9a-f]{64})_\d+x\d+\.jpg$`)
+
+// purgeThumbnails deletes the thumbnails in thumbnail_cache_dir that belong to none of the images currently served.
+// Thumbnail names only carry a hash of the original path, so the current images are hashed instead of reversing it.
+func purgeThumbnails(config *Config) (int, error) {
+	if config.ThumbnailCacheDir == "" {
+		return 0, nil
+	}
+	entries, err := os.ReadDir(config.ThumbnailCacheDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	live := make(map[string]bool)
+	imageDirs := []string{config.ImageDir}
+	for _, dir := range config.ParamSourceMapping {
+		imageDirs = append(imageDirs, dir)
+	}
+	for _, imageDir := range imageDirs {
+		validFiles, err := scanImageFiles(config, imageDir)
+		if err != nil {
+			// An unreadable directory would otherwise look like all of its images were deleted
+			return 0, err
+		}
+		for _, file := range validFiles {
+			live[fmt.Sprintf("%x", sha256.Sum256([]byte(file.Path())))] = true
+		}
+	}
+
+	purged := 0
+	for _, entry := range entries {
+		match := thumbnailName.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || match == nil || live[match[1]] {
+			continue
+		}
+		if err := os.Remove(filepath.Join(config.ThumbnailCacheDir, entry.Name())); err == nil {
+			purged++
+		}
+	}
+	return purged, nil
+}
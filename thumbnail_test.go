@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"image/jpeg"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestThumbnailModeRequiresCacheDir(t *testing.T) {
+	config := (&Config{ImageDir: setupTestDir(t), Mode: "thumbnail"}).WithDefaults()
+	var validationErr *ValidationError
+	if err := prepareConfig(config); !errors.As(err, &validationErr) || validationErr.Field != "thumbnail_cache_dir" {
+		t.Fatalf("prepareConfig = %v, want a thumbnail_cache_dir validation error", err)
+	}
+}
+
+func TestServeThumbnail(t *testing.T) {
+	cacheDir := t.TempDir()
+	config := newTestConfig(t, setupSingleFileDir(t, "image-003.png"), func(c *Config) {
+		c.Mode = "thumbnail"
+		c.ThumbnailCacheDir = cacheDir
+		c.ThumbnailWidth = intPtr(4)
+		c.ThumbnailHeight = intPtr(2)
+	})
+	handler := newTestHandler(t, config)
+	for _, want := range []string{"MISS", "HIT"} {
+		w := serve(handler, http.MethodGet, "/", nil)
+		if w.Code != http.StatusOK || w.Header().Get("X-Cache") != want {
+			t.Fatalf("GET / = %d with X-Cache %q, want 200 with %s", w.Code, w.Header().Get("X-Cache"), want)
+		}
+		img, err := jpeg.Decode(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size := img.Bounds().Size(); size.X != 4 || size.Y != 2 {
+			t.Errorf("thumbnail is %v, want 4x2", size)
+		}
+	}
+}
+
+func TestPurgeThumbnails(t *testing.T) {
+	imageDir, cacheDir := setupTestDir(t), t.TempDir()
+	config := newTestConfig(t, imageDir, func(c *Config) { c.ThumbnailCacheDir = cacheDir })
+
+	live := filepath.Base(thumbnailPath(config, filepath.Join(imageDir, "image-000.jpg")))
+	stale := fmt.Sprintf("%x_200x200.jpg", sha256.Sum256([]byte(filepath.Join(imageDir, "deleted.jpg"))))
+	staleHash := strings.TrimSuffix(stale, "_200x200.jpg")
+	kept := []string{
+		live,
+		"photo.jpg",
+		"notes_1x1.jpg",
+		strings.ToUpper(staleHash) + "_200x200.jpg",
+		staleHash + "_200x200.jpg.bak",
+		staleHash + "_large.jpg",
+		".thumbnail-123",
+	}
+	for _, name := range append([]string{stale}, kept...) {
+		if err := os.WriteFile(filepath.Join(cacheDir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	purged, err := purgeThumbnails(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged != 1 {
+		t.Errorf("purged %d files, want only the stale thumbnail", purged)
+	}
+	if _, err := os.Stat(filepath.Join(cacheDir, stale)); !os.IsNotExist(err) {
+		t.Errorf("stale thumbnail %s was kept", stale)
+	}
+	for _, name := range kept {
+		if _, err := os.Stat(filepath.Join(cacheDir, name)); err != nil {
+			t.Errorf("%s was deleted: %v", name, err)
+		}
+	}
+}
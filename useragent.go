@@ -0,0 +1,39 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// badBotPattern matches the user agents of common vulnerability scanners, blocked when block_bad_bots is true
+var badBotPattern = regexp.MustCompile(`(?i)sqlmap|nikto|masscan|nmap|zgrab|nuclei|dirbuster|gobuster|wpscan|acunetix`)
+
+// isUserAgentBlocked reports whether a User-Agent is rejected: outside allowed_user_agents when that is set,
+// equal to a blocked_user_agents entry, or matching a blocked_user_agent_patterns expression.
+// The allowlist matches case-insensitive substrings while blocked_user_agents only matches the exact string;
+// substring and case-insensitive blocking is done with patterns.
+func isUserAgentBlocked(userAgent string, config *Config) bool {
+	if len(config.AllowedUserAgents) > 0 && !containsSubstringFold(config.AllowedUserAgents, userAgent) {
+		return true
+	}
+	if contains(config.BlockedUserAgents, userAgent) {
+		return true
+	}
+	for _, pattern := range config.userAgentPatterns {
+		if pattern.MatchString(userAgent) {
+			return true
+		}
+	}
+	return false
+}
+
+// containsSubstringFold reports whether s contains one of the substrings, ignoring case
+func containsSubstringFold(substrings []string, s string) bool {
+	s = strings.ToLower(s)
+	for _, substring := range substrings {
+		if strings.Contains(s, strings.ToLower(substring)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestUserAgentRules(t *testing.T) {
+	config := newTestConfig(t, setupTestDir(t), func(c *Config) {
+		c.AllowedUserAgents = []string{"Mozilla/"}
+		c.BlockedUserAgents = []string{"Mozilla/5.0 (BadCrawler)"}
+		c.BlockedUserAgentPatterns = []string{"(?i)headless"}
+	})
+	for _, tc := range []struct {
+		userAgent string
+		blocked   bool
+	}{
+		{"Mozilla/5.0 (X11; Linux x86_64)", false},
+		{"mozilla/4.0", false},             // the allowlist ignores case
+		{"Mozilla/5.0 (BadCrawler)", true}, // blocked_user_agents matches the exact string...
+		{"Mozilla/5.0 (BadCrawler) v2", false},
+		{"Mozilla/5.0 (badcrawler)", false},      // ...including case
+		{"Mozilla/5.0 HeadlessChrome/120", true}, // patterns can match anywhere
+		{"curl/8.0.1", true},                     // outside the allowlist
+		{"", true},
+	} {
+		if got := isUserAgentBlocked(tc.userAgent, config); got != tc.blocked {
+			t.Errorf("isUserAgentBlocked(%q) = %v, want %v", tc.userAgent, got, tc.blocked)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsImage is the message pushed to WebSocket clients for every new image
+type wsImage struct {
+	Filename string `json:"filename"`
+	URL      string `json:"url"`
+}
+
+// wsConnections counts the open WebSocket connections, bounded by max_ws_connections
+var wsConnections atomic.Int64
+
+// wsWriteTimeout bounds each message write, so a client that stops reading does not hold its connection forever
+const wsWriteTimeout = 10 * time.Second
+
+// handleWebSocket upgrades the request to a WebSocket and pushes a random image of the requested source as JSON every
+// ws_push_interval until the client disconnects
+func handleWebSocket(w http.ResponseWriter, r *http.Request, config *Config) {
+	imageDir := resolveImageDir(r, config)
+	if imageDir == "" {
+		writeUnknownSource(w, r)
+		return
+	}
+	if wsConnections.Add(1) > int64(*config.MaxWSConnections) {
+		wsConnections.Add(-1)
+		writeError(w, http.StatusTooManyRequests, "429 Too Many Requests", "TOO_MANY_REQUESTS")
+		return
+	}
+	defer wsConnections.Add(-1)
+
+	upgrader := websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return wsOriginAllowed(r, config) }}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has already answered the client with an error status
+		return
+	}
+	defer conn.Close()
+	// The open connection is bounded by max_ws_connections, so it stops counting against max_concurrent_requests
+	releaseConcurrencySlot(r)
+
+	// Clients only listen, but reading is what notices a disconnect or a close frame
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(config.WSPushInterval)
+	defer ticker.Stop()
+	for {
+		if result, err := selectImage(config, imageDir); err == nil {
+			conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			if err := conn.WriteJSON(wsImage{Filename: filepath.Base(result.FilePath), URL: imageURL(config, result.FilePath)}); err != nil {
+				return
+			}
+		}
+
+		select {
+		case <-closed:
+			conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// wsOriginAllowed accepts same-origin WebSocket handshakes and, with cors_enabled, the allowed_origins
+func wsOriginAllowed(r *http.Request, config *Config) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if *config.CorsEnabled && (contains(config.AllowedOrigins, "*") || contains(config.AllowedOrigins, origin)) {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestOpenWebSocketReleasesConcurrencySlot(t *testing.T) {
+	config := newTestConfig(t, setupTestDir(t), func(c *Config) {
+		c.WebSocket = boolPtr(true)
+		c.WSPushInterval = time.Hour
+	})
+	ts := httptest.NewServer(withConcurrencyLimit(newTestHandler(t, config), 1))
+	defer ts.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// The first image is pushed once the handler has upgraded the connection and released its slot
+	var image wsImage
+	if err := conn.ReadJSON(&image); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.Get(ts.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("GET / with a WebSocket open and max_concurrent_requests 1 = %d, want 200", resp.StatusCode)
+	}
+}